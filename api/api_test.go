@@ -1,19 +1,22 @@
 package api
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/paulsgrudups/testsync/api/runs"
+	"github.com/paulsgrudups/testsync/storage"
 	"github.com/paulsgrudups/testsync/utils"
 )
 
 func TestCreateAndReadTestData(t *testing.T) {
 	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
-	runs.AllTests = make(map[int]*runs.Test)
+	runs.AllTests = make(map[string]*runs.Test)
 
 	handler, err := HandleRoutes()
 	if err != nil {
@@ -50,3 +53,618 @@ func TestCreateAndReadTestData(t *testing.T) {
 		t.Fatalf("unexpected body: %q", string(read))
 	}
 }
+
+func TestTestIDValidation(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		{"/tests/pr-1234-chrome-7f3a", http.StatusOK},
+		{"/tests/run_1.2", http.StatusOK},
+		{"/tests/bad%20id", http.StatusBadRequest},
+		{"/tests/" + strings.Repeat("a", 129), http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader("payload"))
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.code {
+			t.Fatalf("%s: expected status %d, got %d", tc.path, tc.code, rec.Code)
+		}
+	}
+}
+
+func TestReplacePatchDeleteTestData(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/crud", reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodPatch, `{"a":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodPut, `{"a":1,"b":{"c":2}}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	if rec := do(http.MethodPut, `{"a":"x","b":{"c":2}}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected replace to succeed, got %d", rec.Code)
+	}
+
+	rec := do(http.MethodPatch, `{"a":null,"b":{"d":3}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if rec.Body.String() != `{"b":{"c":2,"d":3}}` {
+		t.Fatalf("unexpected patched body: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPatch, `{`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = do(http.MethodGet, "")
+	if rec.Body.String() != `{"b":{"c":2,"d":3}}` {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodDelete, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, body string, headers map[string]string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/etag", reader)
+		req.SetBasicAuth("user", "pass")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := do(http.MethodPut, `{"a":1}`, map[string]string{"If-Match": "*"})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d, got %d", http.StatusPreconditionFailed, rec.Code)
+	}
+
+	rec = do(http.MethodPut, `{"a":1}`, map[string]string{"If-None-Match": "*"})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("unexpected create response: %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = do(http.MethodGet, "", nil)
+	if rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("unexpected ETag: %q", rec.Header().Get("ETag"))
+	}
+
+	rec = do(http.MethodGet, "", map[string]string{"If-None-Match": `"1"`})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected status %d, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	rec = do(http.MethodPut, `{"a":2}`, map[string]string{"If-Match": `"1"`})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("unexpected replace response: %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = do(http.MethodPatch, `{"b":1}`, map[string]string{"If-Match": `"1"`})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d, got %d", http.StatusPreconditionFailed, rec.Code)
+	}
+
+	rec = do(http.MethodPatch, `{"b":1}`, map[string]string{"If-Match": `W/"2"`})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d, got %d", http.StatusPreconditionFailed, rec.Code)
+	}
+
+	rec = do(http.MethodGet, "", map[string]string{"If-None-Match": `W/"2"`})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected status %d, got %d", http.StatusNotModified, rec.Code)
+	}
+
+	rec = do(http.MethodPatch, `{"b":1}`, map[string]string{"If-Match": `"2"`})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"3"` {
+		t.Fatalf("unexpected patch response: %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = do(http.MethodPut, `{}`, map[string]string{"If-Match": "3"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestKeyRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/keys"+path, reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/keys/a", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodPut, "/keys/a", "value"); rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("unexpected key ETag: %q", rec.Header().Get("ETag"))
+	}
+
+	if rec := do(http.MethodPut, "", "blob"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	rec := do(http.MethodGet, "/keys/a", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "value" {
+		t.Fatalf("unexpected key response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, "/keys/"+runs.DefaultKey, "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "blob" {
+		t.Fatalf("unexpected default key response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, "/keys", "")
+	if rec.Body.String() != `{"keys":["a","default"]}` {
+		t.Fatalf("unexpected keys: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPut, "/keys/a!", "value"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/keys/a", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/keys/a", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodGet, "", ""); rec.Body.String() != "blob" {
+		t.Fatalf("expected test data to be kept, got %q", rec.Body.String())
+	}
+}
+
+func TestCounterRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/counters/counters/"+path, reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "seq", ""); rec.Body.String() != `{"name":"seq","value":0}` {
+		t.Fatalf("unexpected counter: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPost, "seq/incr", ""); rec.Body.String() != `{"name":"seq","value":1}` {
+		t.Fatalf("unexpected incr response: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPost, "seq/incr", `{"by":5}`); rec.Body.String() != `{"name":"seq","value":6}` {
+		t.Fatalf("unexpected incr response: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPost, "seq/decr", `{"by":2}`); rec.Body.String() != `{"name":"seq","value":4}` {
+		t.Fatalf("unexpected decr response: %q", rec.Body.String())
+	}
+
+	for _, body := range []string{`{"by":"x"}`, `{"by":0}`, `{"by":-5}`} {
+		if rec := do(http.MethodPost, "seq/decr", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+
+	// test with counters only can still be created.
+	req := httptest.NewRequest(http.MethodPost, "/tests/counters", strings.NewReader("data"))
+	req.SetBasicAuth("user", "pass")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected test to be created, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRoleRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/roles/roles", reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodPut, `{"presenter":0}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec := do(http.MethodPut, `{"presenter":1,"viewer":"*"}`)
+	expected := `{"roles":[{"name":"presenter","count":1},{"name":"viewer","count":"*"}],"assignments":{}}`
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	test, _ := runs.GetTest("roles")
+	if _, err := test.ClaimRole("agent-1", "viewer"); err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+
+	rec = do(http.MethodGet, "")
+	expected = `{"roles":[{"name":"presenter","count":1},{"name":"viewer","count":"*"}],` +
+		`"assignments":{"agent-1":{"role":"viewer","ordinal":0}}}`
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected roles: %q", rec.Body.String())
+	}
+
+	if rec := do(http.MethodPut, `{"viewer":"*"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, rec.Code)
+	}
+}
+
+func TestPoolRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+	runs.SetDataStore(storage.NewMemoryStore())
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, path, reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for _, path := range []string{"/tests/pools/pools/accounts", "/pools/accounts"} {
+		if rec := do(http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+		}
+
+		if rec := do(http.MethodPut, path, `[]`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+
+		rec := do(http.MethodPut, path, `["alice",{"user":"bob"}]`)
+		expected := `{"name":"accounts","free":2,"items":[{"id":1,"item":"alice","leased":false},` +
+			`{"id":2,"item":{"user":"bob"},"leased":false}]}`
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	lease, err := runs.DefaultService.LeaseItem(
+		runs.GlobalPool, "accounts", runs.LeaseRequest{
+			Waiter: runs.Waiter{AgentID: "a"}, TestID: "pools",
+		},
+	)
+	if err != nil {
+		t.Fatalf("lease failed: %v", err)
+	}
+
+	rec := do(http.MethodGet, "/pools/accounts", "")
+	expected := `{"name":"accounts","free":1,"items":[{"id":1,"item":"alice","leased":true,` +
+		`"lease_id":"` + lease.LeaseID + `","test_id":"pools","agent_id":"a"},` +
+		`{"id":2,"item":{"user":"bob"},"leased":false}]}`
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected pool: %q", rec.Body.String())
+	}
+
+	leasePath := "/pools/accounts/leases/" + lease.LeaseID
+	if rec := do(http.MethodDelete, leasePath, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(http.MethodDelete, leasePath, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// test pools are removed along with the test, global ones are kept.
+	if err := runs.DefaultService.DeleteTest("pools"); err != nil {
+		t.Fatalf("delete test failed: %v", err)
+	}
+
+	if rec := do(http.MethodGet, "/tests/pools/pools/accounts", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/pools/accounts", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+}
+
+func TestFeedRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, path, reader)
+		req.SetBasicAuth("user", "pass")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/tests/feeds/feeds/users", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	rec := do(http.MethodPut, "/tests/feeds/feeds/users?strategy=shuffle", "", `1`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = do(http.MethodPut, "/tests/feeds/feeds/users", "text/csv; charset=utf-8", "user\n")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = do(
+		http.MethodPut, "/tests/feeds/feeds/users?strategy=circular", "text/csv",
+		"user\nalice\nbob\n",
+	)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"name":"users","strategy":"circular","rows":2}` {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	test, _ := runs.GetTest("feeds")
+	feed, _ := test.GetFeed("users")
+	if row, err := feed.Next(); err != nil || string(row.Row) != `{"user":"alice"}` {
+		t.Fatalf("unexpected row: %+v, err %v", row, err)
+	}
+
+	rec = do(http.MethodPut, "/tests/feeds/feeds/steps", "application/x-ndjson", "{\"step\":1}\n{\"step\":2}\n")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"name":"steps","strategy":"sequential","rows":2}` {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := do(http.MethodDelete, "/tests/feeds/feeds/steps", "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(http.MethodGet, "/tests/feeds/feeds/steps", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestQueueRoutes(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req := httptest.NewRequest(method, "/tests/queues/queues/steps", reader)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(http.MethodPost, `{"step"`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec := do(http.MethodPost, `{"step":1}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"queue":"steps","task_id":1}` {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	// task delivered to an agent that is gone stays in the queue.
+	test, _ := runs.GetTest("queues")
+	q, _ := test.GetQueue("steps")
+	q.Pop(runs.PopRequest{Waiter: runs.Waiter{AgentID: "gone"}})
+
+	rec = do(http.MethodGet, "")
+	if rec.Body.String() != `{"name":"steps","pending":1,"in_flight":0,"waiting":0}` {
+		t.Fatalf("unexpected queue: %q", rec.Body.String())
+	}
+}
+
+func TestBroadcastRoute(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost, "/tests/broadcast/broadcast", strings.NewReader(body),
+		)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	if rec := do(`{"go"`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec := do(`{"go":true}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"recipients":0}` {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCheckpointStartRoute(t *testing.T) {
+	runs.SyncClient = utils.BasicCredentials{Username: "user", Password: "pass"}
+	runs.AllTests = make(map[string]*runs.Test)
+
+	handler, err := HandleRoutes()
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	do := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPut, "/tests/starts/checkpoints/go/start",
+			strings.NewReader(body),
+		)
+		req.SetBasicAuth("user", "pass")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for _, body := range []string{
+		``, `{"start_at":"soon"}`, `{"start_at":0}`,
+		`{"identifier":"other","start_at":1}`,
+	} {
+		if rec := do(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf(
+				"expected status %d for %q, got %d",
+				http.StatusBadRequest, body, rec.Code,
+			)
+		}
+	}
+
+	startAt := time.Now().Add(time.Minute).UnixMilli()
+	rec := do(fmt.Sprintf(`{"identifier":"go","start_at":%d}`, startAt))
+	if rec.Code != http.StatusOK ||
+		rec.Body.String() != fmt.Sprintf(`{"identifier":"go","start_at":%d}`, startAt) {
+		t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	test, _ := runs.GetTest("starts")
+	cp := test.EnsureCheckpoint("go", runs.CheckpointOptions{TargetCount: 1})
+	defer test.Close()
+
+	if cp.StartAt.UnixMilli() != startAt {
+		t.Fatalf("unexpected checkpoint start time: %s", cp.StartAt)
+	}
+}
@@ -33,6 +33,7 @@ func HandleRoutes() (http.Handler, error) {
 	})
 
 	runs.RegisterTestsRoutes(router)
+	runs.RegisterPoolRoutes(router)
 
 	return router, nil
 }
@@ -0,0 +1,292 @@
+package runs
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/paulsgrudups/testsync/wsutil"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxAgentIDLength = 64
+	// maxQueuedMessages limits how many messages are kept for a disconnected
+	// agent. Oldest messages are dropped first.
+	maxQueuedMessages = 1000
+	// agentWriteTimeout limits how long a single write to agent connection
+	// may block, so a stalled agent does not hold up its senders.
+	agentWriteTimeout = 10 * time.Second
+)
+
+var (
+	// ErrAgentExists indicates that agent ID is already registered in test.
+	ErrAgentExists = errors.New("agent already registered")
+	// ErrInvalidAgentID indicates that provided agent ID is not valid.
+	ErrInvalidAgentID = errors.New("invalid agent ID")
+	// ErrSessionNotFound indicates that there is no agent session to resume.
+	ErrSessionNotFound = errors.New("agent session not found")
+	// ErrInvalidResumeToken indicates that resume token does not match agent.
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	// ErrAgentNotConnected indicates that agent has no active connection.
+	ErrAgentNotConnected = errors.New("agent is not connected")
+
+	// identifierPattern defines allowed characters of test and agent IDs.
+	identifierPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// Waiter describes an agent waiting for messages pushed in reply to one of
+// its requests.
+type Waiter struct {
+	AgentID string
+	// RequestID is echoed in messages sent to the agent.
+	RequestID string
+}
+
+// Agent describes a single WebSocket participant registered to a test. Agent
+// outlives its connection for the resume grace period, messages sent while
+// it's disconnected are queued and delivered once the session is resumed.
+type Agent struct {
+	ID          string
+	ResumeToken string
+	conn        *websocket.Conn
+	queue       []queuedMessage
+	expiry      *time.Timer
+	mu          sync.Mutex
+	// writeMu serializes writes to connection, mu is not held while writing
+	// so state of a slow agent can still be read.
+	writeMu sync.Mutex
+}
+
+// NewAgent creates an agent for provided connection.
+func NewAgent(id, resumeToken string, conn *websocket.Conn) *Agent {
+	return &Agent{ID: id, ResumeToken: resumeToken, conn: conn}
+}
+
+// NewAgentID generates a random agent ID.
+func NewAgentID() string {
+	return randomHex(8)
+}
+
+// NewResumeToken generates a random token for resuming agent session.
+func NewResumeToken() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b) // nolint: errcheck
+
+	return hex.EncodeToString(b)
+}
+
+// ValidateAgentID checks that client supplied agent ID can be used.
+func ValidateAgentID(id string) error {
+	if len(id) == 0 || len(id) > maxAgentIDLength || !identifierPattern.MatchString(id) {
+		return ErrInvalidAgentID
+	}
+
+	return nil
+}
+
+// ValidResumeToken checks whether token allows to resume agent session.
+func (a *Agent) ValidResumeToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(a.ResumeToken), []byte(token)) == 1
+}
+
+// Conn returns the current WebSocket connection, nil if agent is detached.
+func (a *Agent) Conn() *websocket.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.conn
+}
+
+// Connected returns whether agent has an active connection.
+func (a *Agent) Connected() bool {
+	return a.Conn() != nil
+}
+
+// Send marshals and sends a message to agent. Writes are serialized as
+// WebSocket connections support only one concurrent writer.
+func (a *Agent) Send(cmd string, content interface{}) error {
+	return a.Reply("", cmd, content)
+}
+
+// Reply marshals and sends a message to agent, echoing ID of the request it
+// replies to.
+func (a *Agent) Reply(id, cmd string, content interface{}) error {
+	message, err := wsutil.NewReply(id, cmd, content)
+	if err != nil {
+		return err
+	}
+
+	return a.WriteMessage(websocket.TextMessage, message)
+}
+
+// WriteMessage writes a data message to agent connection. If agent is
+// detached, message is queued until the session is resumed.
+func (a *Agent) WriteMessage(messageType int, data []byte) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	msg := queuedMessage{messageType: messageType, data: data}
+
+	a.mu.Lock()
+	conn := a.conn
+	if conn == nil {
+		a.enqueue(msg)
+		a.mu.Unlock()
+		return nil
+	}
+	a.mu.Unlock()
+
+	if err := a.flush(conn); err != nil {
+		return err
+	}
+
+	return writeMessage(conn, msg)
+}
+
+// Flush delivers queued messages to agent connection.
+func (a *Agent) Flush() error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	conn := a.Conn()
+	if conn == nil {
+		return ErrAgentNotConnected
+	}
+
+	return a.flush(conn)
+}
+
+// flush writes queued messages to conn. Messages that could not be written
+// are queued again. Must be called with writeMu held.
+func (a *Agent) flush(conn *websocket.Conn) error {
+	a.mu.Lock()
+	queue := a.queue
+	a.queue = nil
+	a.mu.Unlock()
+
+	for i, msg := range queue {
+		if err := writeMessage(conn, msg); err != nil {
+			a.mu.Lock()
+			pending := a.queue
+			a.queue = nil
+			for _, m := range append(queue[i:], pending...) {
+				a.enqueue(m)
+			}
+			a.mu.Unlock()
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeMessage(conn *websocket.Conn, msg queuedMessage) error {
+	err := conn.SetWriteDeadline(time.Now().Add(agentWriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(msg.messageType, msg.data)
+}
+
+func (a *Agent) enqueue(msg queuedMessage) {
+	if len(a.queue) >= maxQueuedMessages {
+		log.Warnf("Dropping oldest queued message for agent %q", a.ID)
+		a.queue = a.queue[1:]
+	}
+
+	a.queue = append(a.queue, msg)
+}
+
+// attach replaces agent connection and stops session expiry. Returns the
+// previous connection, if any.
+func (a *Agent) attach(conn *websocket.Conn) *websocket.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.expiry != nil {
+		a.expiry.Stop()
+		a.expiry = nil
+	}
+
+	old := a.conn
+	a.conn = conn
+
+	return old
+}
+
+// detach removes connection from agent if it's still the active one.
+func (a *Agent) detach(conn *websocket.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn != conn {
+		return false
+	}
+
+	a.conn = nil
+
+	return true
+}
+
+func (a *Agent) setExpiry(timer *time.Timer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.expiry != nil {
+		a.expiry.Stop()
+	}
+
+	a.expiry = timer
+}
+
+// Close closes agent connection.
+func (a *Agent) Close() error {
+	conn := a.Conn()
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+// closeSession sends close frame to agent connection, closes it and stops
+// session expiry.
+func (a *Agent) closeSession(code int, text string) {
+	a.mu.Lock()
+	conn := a.conn
+	a.conn = nil
+	a.queue = nil
+	if a.expiry != nil {
+		a.expiry.Stop()
+		a.expiry = nil
+	}
+	a.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	conn.WriteControl( // nolint: errcheck, gosec
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Second),
+	)
+	conn.Close() // nolint: errcheck, gosec
+}
@@ -0,0 +1,41 @@
+package runs
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageBroadcast is pushed to every connected agent of a test once an agent
+// or HTTP client broadcasts a message.
+const MessageBroadcast = "broadcast_message"
+
+// BroadcastMessage describes content of a broadcast message.
+type BroadcastMessage struct {
+	// SenderID is empty if message was broadcast over HTTP.
+	SenderID string          `json:"sender_id,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Broadcast pushes a message to every agent with an active connection,
+// skipping the sender if excludeSender is set. Returns number of agents the
+// message was sent to.
+func (t *Test) Broadcast(msg BroadcastMessage, excludeSender bool) int {
+	recipients := 0
+
+	for agentID, agent := range t.GetConnectionsSnapshot() {
+		if excludeSender && agentID == msg.SenderID || !agent.Connected() {
+			continue
+		}
+
+		if err := agent.Send(MessageBroadcast, msg); err != nil {
+			log.Errorf("Could not broadcast message to agent %q: %s",
+				agentID, err.Error())
+			continue
+		}
+
+		recipients++
+	}
+
+	return recipients
+}
@@ -0,0 +1,56 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerBroadcastRoutes registers route broadcasting messages to agents.
+func registerBroadcastRoutes(r *mux.Router) {
+	r.HandleFunc(`/broadcast`, broadcastHandler).Methods(http.MethodPost)
+}
+
+// broadcastHandler pushes request body, a JSON document, to every connected
+// agent of the test.
+func broadcastHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		log.Errorf("Could not get test ID: %s", err.Error())
+		return
+	}
+
+	logger := log.WithField("test_id", testID)
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	if !json.Valid(body) {
+		utils.HTTPError(w, "Message must be a JSON document", http.StatusBadRequest)
+		return
+	}
+
+	recipients := 0
+	if t, ok := GetTest(testID); ok {
+		recipients = t.Broadcast(BroadcastMessage{Data: body}, false)
+	}
+
+	logger.Debugf("Broadcast message to %d agents", recipients)
+
+	resp, err := json.Marshal(struct {
+		Recipients int `json:"recipients"`
+	}{Recipients: recipients})
+	if err != nil {
+		utils.HTTPError(w, "Could not encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
@@ -0,0 +1,165 @@
+package runs
+
+import (
+	"encoding/json"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageChannel is pushed to agents subscribed to a channel once a message
+// is published to it.
+const MessageChannel = "channel_message"
+
+// maxChannelHistory limits how many published messages a channel keeps for
+// replay.
+const maxChannelHistory = 1000
+
+// ChannelMessage describes a message published to a channel.
+type ChannelMessage struct {
+	Channel string `json:"channel"`
+	// Seq orders messages of a channel, starting from 1.
+	Seq      int64           `json:"seq"`
+	SenderID string          `json:"sender_id"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Channel describes a named publish/subscribe channel of a test. Channel keeps
+// up to History last published messages so late subscribers can replay them.
+type Channel struct {
+	Name    string
+	History int
+	// subscribers hold request IDs of subscriptions by agent ID.
+	subscribers map[string]string
+	history     []ChannelMessage
+	seq         int64
+	t           *Test
+	mu          sync.Mutex
+}
+
+// NewChannel creates a channel for provided test.
+func NewChannel(name string, t *Test) *Channel {
+	return &Channel{Name: name, subscribers: make(map[string]string), t: t}
+}
+
+// Subscribe subscribes agent to channel, request ID is echoed in every pushed
+// message. Returns messages kept in channel history.
+func (c *Channel) Subscribe(subscriber Waiter) []ChannelMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribers[subscriber.AgentID] = subscriber.RequestID
+
+	history := make([]ChannelMessage, len(c.history))
+	copy(history, c.history)
+
+	return history
+}
+
+// Unsubscribe stops agent subscription. Returns false if agent was not
+// subscribed.
+func (c *Channel) Unsubscribe(agentID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subscribers[agentID]; !ok {
+		return false
+	}
+
+	delete(c.subscribers, agentID)
+
+	return true
+}
+
+// Publish pushes a message to all subscribers, including the sender if it's
+// subscribed. Returns published message and number of subscribers it was
+// sent to.
+func (c *Channel) Publish(senderID string, data json.RawMessage) (ChannelMessage, int) {
+	c.mu.Lock()
+	c.seq++
+	msg := ChannelMessage{Channel: c.Name, Seq: c.seq, SenderID: senderID, Data: data}
+
+	if c.History > 0 {
+		c.history = append(c.history, msg)
+		if len(c.history) > c.History {
+			c.history = c.history[len(c.history)-c.History:]
+		}
+	}
+
+	subscribers := make(map[string]string, len(c.subscribers))
+	for agentID, requestID := range c.subscribers {
+		subscribers[agentID] = requestID
+	}
+	c.mu.Unlock()
+
+	for agentID, requestID := range subscribers {
+		agent := c.t.GetConnection(agentID)
+		if agent == nil {
+			continue
+		}
+
+		if err := agent.Reply(requestID, MessageChannel, msg); err != nil {
+			log.Errorf("Could not send message of channel %q to agent %q: %s",
+				c.Name, agentID, err.Error())
+		}
+	}
+
+	return msg, len(subscribers)
+}
+
+// KeepHistory raises number of messages kept for replay, up to 1000. History
+// is never shrunk as other agents may rely on it.
+func (c *Channel) KeepHistory(size int) {
+	if size > maxChannelHistory {
+		size = maxChannelHistory
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.History {
+		c.History = size
+	}
+}
+
+// EnsureChannel gets or creates a named channel.
+func (t *Test) EnsureChannel(name string) *Channel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.Channels[name]; ok {
+		return c
+	}
+
+	if t.Channels == nil {
+		t.Channels = make(map[string]*Channel)
+	}
+
+	c := NewChannel(name, t)
+	t.Channels[name] = c
+
+	return c
+}
+
+// GetChannel returns a channel by name.
+func (t *Test) GetChannel(name string) (*Channel, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	c, ok := t.Channels[name]
+	return c, ok
+}
+
+// unsubscribeAll stops all channel subscriptions of agent.
+func (t *Test) unsubscribeAll(agentID string) {
+	t.mu.RLock()
+	channels := make([]*Channel, 0, len(t.Channels))
+	for _, c := range t.Channels {
+		channels = append(channels, c)
+	}
+	t.mu.RUnlock()
+
+	for _, c := range channels {
+		c.Unsubscribe(agentID)
+	}
+}
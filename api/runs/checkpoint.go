@@ -1,66 +1,219 @@
 package runs
 
 import (
+	"encoding/json"
 	"sync"
 	"time"
 
-	"github.com/paulsgrudups/testsync/wsutil"
 	log "github.com/sirupsen/logrus"
 )
 
+// CheckpointReasonTimeout is sent to waiting connections when checkpoint did
+// not reach its target count in time.
+const CheckpointReasonTimeout = "timeout"
+
+// DefaultStartDelay defines how long after release released connections
+// start, unless checkpoint sets its own delay or start time.
+var DefaultStartDelay = 500 * time.Millisecond
+
+// CheckpointOptions describes settings applied when a checkpoint is created.
+type CheckpointOptions struct {
+	TargetCount int
+	// Timeout defines how long participants may wait for the target count to
+	// be reached. Zero disables the timeout.
+	Timeout time.Duration
+	// Cyclic checkpoints reset after every release and can be reused.
+	Cyclic bool
+	// StartDelay defines how long after release released connections start.
+	// Nil uses DefaultStartDelay.
+	StartDelay *time.Duration
+	// StartAt defines absolute start time of released connections. It's used
+	// instead of StartDelay unless it has passed by the release.
+	StartAt time.Time
+}
+
+// CheckpointMember describes an agent waiting at the checkpoint.
+type CheckpointMember struct {
+	Waiter
+	// Payload is shared with all participants released together with the
+	// member.
+	Payload json.RawMessage
+}
+
 // Checkpoint describes a single checkpoint instance.
 type Checkpoint struct {
-	Identifier    string
-	TargetCount   int
-	ConnectionIdx []int
-	Finished      bool
-	connEvents    chan bool
-	mu            sync.Mutex
+	Identifier  string
+	TargetCount int
+	Timeout     time.Duration
+	Cyclic      bool
+	StartDelay  time.Duration
+	StartAt     time.Time
+	Generation  int
+	Members     []CheckpointMember
+	Finished    bool
+	TimedOut    bool
+	connEvents  chan bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+	mu          sync.Mutex
 }
 
-// CreateCheckpoint create a new checkpoint for specified test.
-func CreateCheckpoint(identifier string, target int, t *Test) *Checkpoint {
+// CreateCheckpoint create a new checkpoint for specified test. If timeout is
+// set, waiting connections are notified about a failure once it elapses
+// before target count is reached.
+func CreateCheckpoint(
+	identifier string, opts CheckpointOptions, t *Test,
+) *Checkpoint {
 	log.Infof("Creating new checkpoint %q", identifier)
 
+	startDelay := DefaultStartDelay
+	if opts.StartDelay != nil {
+		startDelay = *opts.StartDelay
+	}
+
 	cp := &Checkpoint{
 		Identifier:  identifier,
-		TargetCount: target,
+		TargetCount: opts.TargetCount,
+		Timeout:     opts.Timeout,
+		Cyclic:      opts.Cyclic,
+		StartDelay:  startDelay,
+		StartAt:     opts.StartAt,
 		connEvents:  make(chan bool),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 
-	go func() {
-		for range cp.connEvents {
-			log.Info("Got event, checking!")
-			cp.mu.Lock()
-			finished := len(cp.ConnectionIdx) >= cp.TargetCount
-			if finished {
+	go cp.run(t)
+
+	return cp
+}
+
+func (cp *Checkpoint) run(t *Test) {
+	defer close(cp.done)
+
+	// timer is started by the first participant of every generation, so
+	// timeout of a cyclic checkpoint is measured per generation and not from
+	// its creation.
+	var (
+		timer    *time.Timer
+		timeoutC <-chan time.Time
+	)
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timeoutC = nil, nil
+	}
+	defer stopTimer()
+
+	for {
+		select {
+		case <-cp.connEvents:
+			log.Debug("Got event, checking!")
+			if timer == nil && cp.Timeout > 0 {
+				timer = time.NewTimer(cp.Timeout)
+				timeoutC = timer.C
+			}
+
+			for {
+				released, generation, ok := cp.release()
+				if !ok {
+					break
+				}
+
 				log.Debug("Connection target reached - broadcasting")
-				cp.Finished = true
+				stopTimer()
+				cp.broadcastStatus(t, released, generation)
+
+				if !cp.Cyclic {
+					return
+				}
 			}
-			cp.mu.Unlock()
 
-			if finished {
-				cp.broadcastStatus(t)
-				break
+			// Participants above the target count already wait for the
+			// next generation.
+			if timer == nil && cp.Timeout > 0 && len(cp.Participants()) > 0 {
+				timer = time.NewTimer(cp.Timeout)
+				timeoutC = timer.C
+			}
+		case <-timeoutC:
+			log.Debugf("Checkpoint %q timed out - broadcasting", cp.Identifier)
+			stopTimer()
+
+			if cp.Cyclic {
+				cp.timeoutGeneration(t)
+				continue
 			}
+
+			cp.mu.Lock()
+			cp.TimedOut = true
+			cp.mu.Unlock()
+
+			cp.broadcastTimeout(t)
+			return
+		case <-cp.stop:
+			log.Debugf("Checkpoint %q stopped", cp.Identifier)
+			return
 		}
-	}()
+	}
+}
 
-	return cp
+// Stop stops checkpoint without notifying waiting agents.
+func (cp *Checkpoint) Stop() {
+	cp.stopOnce.Do(func() { close(cp.stop) })
+}
+
+// release checks whether target count is reached and returns participants
+// that should be released. Cyclic checkpoints are reset for next generation,
+// keeping participants above the target count as waiting ones.
+func (cp *Checkpoint) release() ([]CheckpointMember, int, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if len(cp.Members) < cp.TargetCount || len(cp.Members) == 0 {
+		return nil, 0, false
+	}
+
+	generation := cp.Generation
+
+	if !cp.Cyclic {
+		cp.Finished = true
+
+		released := make([]CheckpointMember, len(cp.Members))
+		copy(released, cp.Members)
+
+		return released, generation, true
+	}
+
+	released := make([]CheckpointMember, cp.TargetCount)
+	copy(released, cp.Members)
+
+	cp.Members = append([]CheckpointMember{}, cp.Members[cp.TargetCount:]...)
+	cp.Generation++
+
+	return released, generation, true
 }
 
-// AddConnection adds connection index to checkpoint.
-func (cp *Checkpoint) AddConnection(idx int) {
+// AddConnection adds agent to checkpoint. Returns false if checkpoint has
+// already finished or timed out and agent was not added.
+func (cp *Checkpoint) AddConnection(member CheckpointMember) bool {
 	log.Debugf("Adding connection to checkpoint %q", cp.Identifier)
 
 	cp.mu.Lock()
-	cp.ConnectionIdx = append(cp.ConnectionIdx, idx)
-	finished := cp.Finished
+	if cp.Finished || cp.TimedOut {
+		cp.mu.Unlock()
+		return false
+	}
+	cp.Members = append(cp.Members, member)
 	cp.mu.Unlock()
 
-	if !finished {
-		cp.connEvents <- true
+	select {
+	case cp.connEvents <- true:
+	case <-cp.done:
 	}
+
+	return true
 }
 
 // IsFinished returns whether checkpoint has completed.
@@ -71,33 +224,165 @@ func (cp *Checkpoint) IsFinished() bool {
 	return cp.Finished
 }
 
-func (cp *Checkpoint) broadcastStatus(t *Test) {
+// IsTimedOut returns whether checkpoint has timed out.
+func (cp *Checkpoint) IsTimedOut() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.TimedOut
+}
+
+// GetGeneration returns current checkpoint generation.
+func (cp *Checkpoint) GetGeneration() int {
 	cp.mu.Lock()
-	indices := make([]int, len(cp.ConnectionIdx))
-	copy(indices, cp.ConnectionIdx)
-	finished := cp.Finished
+	defer cp.mu.Unlock()
+
+	return cp.Generation
+}
+
+// SetStartAt sets absolute start time of connections released from now on.
+func (cp *Checkpoint) SetStartAt(startAt time.Time) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.StartAt = startAt
+}
+
+// startAt returns start time of connections released now.
+func (cp *Checkpoint) startAt() time.Time {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	now := time.Now()
+	if cp.StartAt.After(now) {
+		return cp.StartAt
+	}
+
+	if cp.StartDelay < 0 {
+		return now
+	}
+
+	return now.Add(cp.StartDelay)
+}
+
+// Participants returns a snapshot of agent IDs that are waiting at the
+// checkpoint.
+func (cp *Checkpoint) Participants() []string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	ids := make([]string, len(cp.Members))
+	for i, member := range cp.Members {
+		ids[i] = member.AgentID
+	}
+
+	return ids
+}
+
+// broadcastStatus notifies released members. If any of them provided a
+// payload, every member receives payloads of all released members by agent
+// ID, null for members without one.
+func (cp *Checkpoint) broadcastStatus(
+	t *Test, members []CheckpointMember, generation int,
+) {
+	var payloads map[string]json.RawMessage
+	for _, member := range members {
+		if member.Payload == nil {
+			continue
+		}
+
+		payloads = make(map[string]json.RawMessage, len(members))
+		for _, m := range members {
+			payloads[m.AgentID] = m.Payload
+		}
+		break
+	}
+
+	cp.broadcast(t, members, struct {
+		Identifier string                     `json:"identifier"`
+		Finished   bool                       `json:"finished"`
+		Generation int                        `json:"generation"`
+		StartAt    int64                      `json:"start_at"`
+		Payloads   map[string]json.RawMessage `json:"payloads,omitempty"`
+	}{
+		Identifier: cp.Identifier,
+		Finished:   true,
+		Generation: generation,
+		StartAt:    cp.startAt().UnixMilli(),
+		Payloads:   payloads,
+	})
+}
+
+func (cp *Checkpoint) broadcastTimeout(t *Test) {
+	cp.mu.Lock()
+	members := make([]CheckpointMember, len(cp.Members))
+	copy(members, cp.Members)
+	generation := cp.Generation
+	cp.mu.Unlock()
+
+	cp.broadcast(t, members, cp.timeoutStatus(members, generation))
+}
+
+// timeoutGeneration notifies participants of the current generation of a
+// cyclic checkpoint about the timeout and starts the next generation.
+func (cp *Checkpoint) timeoutGeneration(t *Test) {
+	cp.mu.Lock()
+	members := cp.Members
+	generation := cp.Generation
+	cp.Members = nil
+	cp.Generation++
 	cp.mu.Unlock()
 
+	cp.broadcast(t, members, cp.timeoutStatus(members, generation))
+}
+
+// TimeoutStatus returns the message content sent to connections when
+// checkpoint has timed out.
+func (cp *Checkpoint) TimeoutStatus() interface{} {
+	cp.mu.Lock()
+	members := make([]CheckpointMember, len(cp.Members))
+	copy(members, cp.Members)
+	generation := cp.Generation
+	cp.mu.Unlock()
+
+	return cp.timeoutStatus(members, generation)
+}
+
+func (cp *Checkpoint) timeoutStatus(
+	members []CheckpointMember, generation int,
+) interface{} {
+	participants := make([]string, len(members))
+	for i, member := range members {
+		participants[i] = member.AgentID
+	}
+
+	return struct {
+		Identifier   string   `json:"identifier"`
+		Finished     bool     `json:"finished"`
+		Generation   int      `json:"generation"`
+		Reason       string   `json:"reason"`
+		Participants []string `json:"participants"`
+	}{
+		Identifier:   cp.Identifier,
+		Finished:     false,
+		Generation:   generation,
+		Reason:       CheckpointReasonTimeout,
+		Participants: participants,
+	}
+}
+
+func (cp *Checkpoint) broadcast(
+	t *Test, members []CheckpointMember, content interface{},
+) {
 	connections := t.GetConnectionsSnapshot()
 
-	for _, idx := range indices {
-		if idx < 0 || idx >= len(connections) {
+	for _, member := range members {
+		agent, ok := connections[member.AgentID]
+		if !ok {
 			continue
 		}
 
-		err := wsutil.SendMessage(
-			connections[idx],
-			"wait_checkpoint",
-			struct {
-				Identifier string `json:"identifier"`
-				Finished   bool   `json:"finished"`
-				StartAt    int64  `json:"start_at"`
-			}{
-				Identifier: cp.Identifier,
-				Finished:   finished,
-				StartAt:    time.Now().Add(time.Millisecond * 500).UnixMilli(),
-			},
-		)
+		err := agent.Reply(member.RequestID, "wait_checkpoint", content)
 		if err != nil {
 			log.Errorf(
 				"Could not broadcast message to checkpoint %q: %s",
@@ -0,0 +1,72 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointStart describes absolute start time of a checkpoint.
+type CheckpointStart struct {
+	Identifier string `json:"identifier"`
+	// StartAt is the start time in epoch millis.
+	StartAt int64 `json:"start_at"`
+}
+
+// registerCheckpointRoutes registers routes of test checkpoints.
+func registerCheckpointRoutes(r *mux.Router) {
+	r.HandleFunc(`/checkpoints/{name}/start`, checkpointStartHandler).
+		Methods(http.MethodPut)
+}
+
+// checkpointStartHandler sets absolute start time of connections released by
+// a checkpoint from request body {"start_at": <epoch millis>}. Checkpoint
+// does not need to exist yet. Identifier in body, if set, must match the
+// path one.
+func checkpointStartHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "checkpoint": name})
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	start := CheckpointStart{Identifier: name}
+	if err := json.Unmarshal(body, &start); err != nil || start.StartAt <= 0 {
+		utils.HTTPError(
+			w, "Start time must be {\"start_at\": <epoch millis>}",
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	if start.Identifier != name {
+		utils.HTTPError(
+			w, "Identifier must match checkpoint in path", http.StatusBadRequest,
+		)
+		return
+	}
+
+	ensureTest(testID).SetCheckpointStart(name, time.UnixMilli(start.StartAt))
+
+	logger.Debugf("Set checkpoint start time to %d", start.StartAt)
+
+	resp, err := json.Marshal(start)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
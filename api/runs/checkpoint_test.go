@@ -0,0 +1,191 @@
+package runs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckpoint_Timeout(t *testing.T) {
+	test := &Test{CheckPoints: make(map[string]*Checkpoint)}
+
+	cp := test.EnsureCheckpoint("cp", CheckpointOptions{
+		TargetCount: 2,
+		Timeout:     20 * time.Millisecond,
+	})
+	if !cp.AddConnection(member("a")) {
+		t.Fatal("expected connection to be added")
+	}
+
+	select {
+	case <-cp.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected checkpoint goroutine to exit after timeout")
+	}
+
+	if !cp.IsTimedOut() || cp.IsFinished() {
+		t.Fatalf(
+			"unexpected state: timed_out=%v finished=%v",
+			cp.IsTimedOut(), cp.IsFinished(),
+		)
+	}
+
+	if cp.AddConnection(member("b")) {
+		t.Fatal("expected timed out checkpoint to reject connection")
+	}
+
+	if got := cp.Participants(); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("unexpected participants: %v", got)
+	}
+}
+
+func TestCheckpoint_FinishedBeforeTimeout(t *testing.T) {
+	test := &Test{CheckPoints: make(map[string]*Checkpoint)}
+
+	cp := test.EnsureCheckpoint("cp", CheckpointOptions{
+		TargetCount: 1,
+		Timeout:     time.Second,
+	})
+	cp.AddConnection(member("a"))
+
+	select {
+	case <-cp.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected checkpoint goroutine to exit after finishing")
+	}
+
+	if !cp.IsFinished() || cp.IsTimedOut() {
+		t.Fatalf(
+			"unexpected state: timed_out=%v finished=%v",
+			cp.IsTimedOut(), cp.IsFinished(),
+		)
+	}
+}
+
+func TestCheckpoint_Cyclic(t *testing.T) {
+	test := &Test{CheckPoints: make(map[string]*Checkpoint)}
+
+	cp := test.EnsureCheckpoint("cp", CheckpointOptions{
+		TargetCount: 2,
+		Cyclic:      true,
+	})
+
+	for round := 0; round < 3; round++ {
+		if !cp.AddConnection(member("a")) || !cp.AddConnection(member("b")) {
+			t.Fatalf("expected connections to be added in round %d", round)
+		}
+
+		if !waitForGeneration(cp, round+1) {
+			t.Fatalf(
+				"expected generation %d, got %d", round+1, cp.GetGeneration(),
+			)
+		}
+
+		if cp.IsFinished() {
+			t.Fatal("expected cyclic checkpoint to never finish")
+		}
+	}
+
+	if got := cp.Participants(); len(got) != 0 {
+		t.Fatalf("expected checkpoint to be reset, got %v", got)
+	}
+}
+
+func TestCheckpoint_CyclicTimeout(t *testing.T) {
+	test := &Test{CheckPoints: make(map[string]*Checkpoint)}
+
+	cp := test.EnsureCheckpoint("cp", CheckpointOptions{
+		TargetCount: 2,
+		Timeout:     20 * time.Millisecond,
+		Cyclic:      true,
+	})
+
+	if !cp.AddConnection(member("a")) {
+		t.Fatal("expected connection to be added")
+	}
+
+	if !waitForGeneration(cp, 1) {
+		t.Fatalf("expected generation 1 after timeout, got %d", cp.GetGeneration())
+	}
+
+	if cp.IsTimedOut() {
+		t.Fatal("expected cyclic checkpoint to stay usable after timeout")
+	}
+
+	if got := cp.Participants(); len(got) != 0 {
+		t.Fatalf("expected timed out generation to be reset, got %v", got)
+	}
+
+	if !cp.AddConnection(member("a")) || !cp.AddConnection(member("b")) {
+		t.Fatal("expected connections to be added after timeout")
+	}
+
+	if !waitForGeneration(cp, 2) {
+		t.Fatalf("expected generation 2 after release, got %d", cp.GetGeneration())
+	}
+}
+
+func waitForGeneration(cp *Checkpoint, generation int) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cp.GetGeneration() == generation {
+			return true
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+// member returns checkpoint member of agent without request ID or payload.
+func member(agentID string) CheckpointMember {
+	return CheckpointMember{Waiter: Waiter{AgentID: agentID}}
+}
+
+func TestCheckpoint_StartAt(t *testing.T) {
+	test := &Test{CheckPoints: make(map[string]*Checkpoint)}
+
+	delay := 2 * time.Second
+	cp := test.EnsureCheckpoint("delayed", CheckpointOptions{
+		TargetCount: 1,
+		StartDelay:  &delay,
+	})
+	if got := time.Until(cp.startAt()); got < time.Second || got > delay {
+		t.Fatalf("unexpected start delay: %s", got)
+	}
+
+	cp = test.EnsureCheckpoint("default", CheckpointOptions{TargetCount: 1})
+	if cp.StartDelay != DefaultStartDelay {
+		t.Fatalf("expected default start delay, got %s", cp.StartDelay)
+	}
+
+	// start time set before checkpoint is created overrides the one of the
+	// creating agent.
+	startAt := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	test.SetCheckpointStart("absolute", startAt)
+	cp = test.EnsureCheckpoint("absolute", CheckpointOptions{
+		TargetCount: 1,
+		StartAt:     time.Now().Add(time.Hour),
+	})
+	if !cp.startAt().Equal(startAt) {
+		t.Fatalf("unexpected start time: %s", cp.startAt())
+	}
+
+	// start times of checkpoints not created before they pass are dropped.
+	test.SetCheckpointStart("late", time.Now().Add(time.Minute))
+	test.SetCheckpointStart("passed", time.Now().Add(-time.Minute))
+	if _, ok := test.checkpointStarts["passed"]; ok {
+		t.Fatal("expected passed start time to be dropped")
+	}
+	if _, ok := test.checkpointStarts["late"]; !ok {
+		t.Fatal("expected pending start time to be kept")
+	}
+
+	// passed start time falls back to the delay.
+	test.SetCheckpointStart("absolute", time.Now().Add(-time.Minute))
+	if got := time.Until(cp.startAt()); got < 0 || got > DefaultStartDelay {
+		t.Fatalf("unexpected start delay: %s", got)
+	}
+
+	test.Close()
+}
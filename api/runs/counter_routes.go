@@ -0,0 +1,114 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// CounterValue describes counter value in HTTP and WebSocket responses.
+type CounterValue struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// registerCounterRoutes registers routes of counters within a test.
+func registerCounterRoutes(r *mux.Router) {
+	r.HandleFunc(`/counters/{name}`, readCounterHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/counters/{name}/incr`, counterHandler(1)).
+		Methods(http.MethodPost)
+	r.HandleFunc(`/counters/{name}/decr`, counterHandler(-1)).
+		Methods(http.MethodPost)
+}
+
+func readCounterHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := DefaultService.GetCounter(testID, name)
+	if err != nil {
+		log.WithFields(log.Fields{"test_id": testID, "counter": name}).
+			Errorf("Could not read counter: %s", err.Error())
+		utils.HTTPError(w, "Could not read counter", http.StatusInternalServerError)
+		return
+	}
+
+	writeCounter(w, CounterValue{Name: name, Value: value})
+}
+
+// counterHandler returns a handler that changes counter in provided
+// direction. Optional request body {"by": <int>} sets the positive step,
+// default 1.
+func counterHandler(sign int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		testID, name, ok := getPathName(w, r)
+		if !ok {
+			return
+		}
+
+		logger := log.WithFields(log.Fields{"test_id": testID, "counter": name})
+
+		body, err := readBodyData(w, r.Body)
+		if err != nil {
+			logger.Errorf("Could not read body data: %s", err.Error())
+			return
+		}
+
+		req := struct {
+			By int64 `json:"by"`
+		}{By: 1}
+
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req); err != nil || req.By <= 0 {
+				utils.HTTPError(
+					w, "Counter step must be {\"by\": <positive int>}",
+					http.StatusBadRequest,
+				)
+				return
+			}
+		}
+
+		value, err := DefaultService.AddCounter(testID, name, sign*req.By)
+		if err != nil {
+			logger.Errorf("Could not change counter: %s", err.Error())
+			utils.HTTPError(
+				w, "Could not change counter", http.StatusInternalServerError,
+			)
+			return
+		}
+
+		writeCounter(w, CounterValue{Name: name, Value: value})
+	}
+}
+
+func writeCounter(w http.ResponseWriter, counter CounterValue) {
+	resp, err := json.Marshal(counter)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode counter", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
+
+// getPathName returns validated test ID and name of a coordination primitive
+// from path variables. In case of invalid values, error response is written.
+func getPathName(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return "", "", false
+	}
+
+	name, err := GetPathID(w, r, "name")
+	if err != nil {
+		return "", "", false
+	}
+
+	return testID, name, true
+}
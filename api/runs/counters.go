@@ -0,0 +1,14 @@
+package runs
+
+// AddCounter atomically adds delta to a named counter within test and
+// returns its new value. Counters start from 0.
+func (s *Service) AddCounter(testID, name string, delta int64) (int64, error) {
+	return s.store().AddCounter(testID, name, delta)
+}
+
+// GetCounter returns value of a named counter, 0 if it was never changed.
+func (s *Service) GetCounter(testID, name string) (int64, error) {
+	value, _, err := s.store().LoadCounter(testID, name)
+
+	return value, err
+}
@@ -0,0 +1,45 @@
+package runs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// DataEncoding... describes how test data is encoded in DataContent.
+const (
+	DataEncodingJSON   = "json"
+	DataEncodingBase64 = "base64"
+)
+
+// DataContent describes test data in WebSocket messages. Data that is valid
+// JSON is embedded as is, any other data is sent as base64 encoded string.
+type DataContent struct {
+	Encoding string          `json:"encoding"`
+	Data     json.RawMessage `json:"data"`
+	Version  int64           `json:"version"`
+}
+
+// NewDataContent creates message content for provided test data version.
+func NewDataContent(data []byte, version int64) DataContent {
+	content := DataContent{Encoding: DataEncodingJSON, Version: version}
+
+	switch {
+	case len(data) == 0:
+		content.Data = json.RawMessage("null")
+	case json.Valid(data):
+		content.Data = data
+	default:
+		encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(data)) // nolint: errcheck
+
+		content.Encoding = DataEncodingBase64
+		content.Data = encoded
+	}
+
+	return content
+}
+
+// KeyContent describes value of a named key in WebSocket messages.
+type KeyContent struct {
+	Key string `json:"key"`
+	DataContent
+}
@@ -19,17 +19,17 @@ func SetDataStore(store storage.DataStore) {
 }
 
 // SaveData persists test data.
-func SaveData(testID int, data []byte) error {
+func SaveData(testID string, data []byte) error {
 	return Store.SaveData(testID, data)
 }
 
 // LoadData retrieves test data.
-func LoadData(testID int) ([]byte, bool, error) {
+func LoadData(testID string) ([]byte, bool, error) {
 	return Store.LoadData(testID)
 }
 
 // DeleteData removes test data.
-func DeleteData(testID int) error {
+func DeleteData(testID string) error {
 	return Store.DeleteData(testID)
 }
 
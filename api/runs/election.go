@@ -0,0 +1,171 @@
+package runs
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageLeaderChanged is pushed to election participants once a new leader
+// is elected.
+const MessageLeaderChanged = "leader_changed"
+
+// ElectionStatus describes election state as seen by a single participant.
+type ElectionStatus struct {
+	Name     string `json:"name"`
+	LeaderID string `json:"leader_id"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+// Election describes a named leader election among agents of a test. The
+// first participant becomes the leader, once its connection drops the
+// longest waiting participant takes over.
+type Election struct {
+	Name string
+	// participants are kept in order of joining, the first one is the leader.
+	participants []Waiter
+	t            *Test
+	mu           sync.Mutex
+}
+
+// NewElection creates an election for provided test.
+func NewElection(name string, t *Test) *Election {
+	return &Election{Name: name, t: t}
+}
+
+// Join adds agent to election and returns its status. Joining again only
+// updates request ID echoed in leader_changed messages.
+func (e *Election) Join(member Waiter) ElectionStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	joined := false
+	for i, participant := range e.participants {
+		if participant.AgentID == member.AgentID {
+			e.participants[i] = member
+			joined = true
+		}
+	}
+
+	if !joined {
+		e.participants = append(e.participants, member)
+	}
+
+	return e.status(member.AgentID)
+}
+
+// Leave removes agent from election. If agent was the leader, a new one is
+// elected and all participants are notified.
+func (e *Election) Leave(agentID string) {
+	e.mu.Lock()
+
+	wasLeader := e.leader() == agentID
+
+	for i, participant := range e.participants {
+		if participant.AgentID == agentID {
+			e.participants = append(e.participants[:i], e.participants[i+1:]...)
+			break
+		}
+	}
+
+	if !wasLeader || len(e.participants) == 0 {
+		e.mu.Unlock()
+		return
+	}
+
+	participants := make([]Waiter, len(e.participants))
+	copy(participants, e.participants)
+	e.mu.Unlock()
+
+	log.Debugf("Election %q elected %q", e.Name, participants[0].AgentID)
+
+	for _, participant := range participants {
+		e.notify(participant, ElectionStatus{
+			Name:     e.Name,
+			LeaderID: participants[0].AgentID,
+			IsLeader: participant.AgentID == participants[0].AgentID,
+		})
+	}
+}
+
+// Leader returns ID of the current leader, empty if there are no
+// participants.
+func (e *Election) Leader() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader()
+}
+
+func (e *Election) leader() string {
+	if len(e.participants) == 0 {
+		return ""
+	}
+
+	return e.participants[0].AgentID
+}
+
+func (e *Election) status(agentID string) ElectionStatus {
+	leader := e.leader()
+
+	return ElectionStatus{
+		Name:     e.Name,
+		LeaderID: leader,
+		IsLeader: leader == agentID,
+	}
+}
+
+func (e *Election) notify(member Waiter, status ElectionStatus) {
+	agent := e.t.GetConnection(member.AgentID)
+	if agent == nil {
+		return
+	}
+
+	err := agent.Reply(member.RequestID, MessageLeaderChanged, status)
+	if err != nil {
+		log.Errorf("Could not notify agent %q about election %q: %s",
+			member.AgentID, e.Name, err.Error())
+	}
+}
+
+// EnsureElection gets or creates a named election.
+func (t *Test) EnsureElection(name string) *Election {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.Elections[name]; ok {
+		return e
+	}
+
+	if t.Elections == nil {
+		t.Elections = make(map[string]*Election)
+	}
+
+	e := NewElection(name, t)
+	t.Elections[name] = e
+
+	return e
+}
+
+// GetElection returns an election by name.
+func (t *Test) GetElection(name string) (*Election, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	e, ok := t.Elections[name]
+	return e, ok
+}
+
+// leaveElections removes agent from all elections of test.
+func (t *Test) leaveElections(agentID string) {
+	t.mu.RLock()
+	elections := make([]*Election, 0, len(t.Elections))
+	for _, e := range t.Elections {
+		elections = append(elections, e)
+	}
+	t.mu.RUnlock()
+
+	for _, e := range elections {
+		e.Leave(agentID)
+	}
+}
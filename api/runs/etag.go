@@ -0,0 +1,87 @@
+package runs
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// formatETag returns entity tag for test data version.
+func formatETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseETag returns test data version from entity tag and whether the tag is
+// weak.
+func parseETag(tag string) (int64, bool, error) {
+	tag = strings.TrimSpace(tag)
+	weak := strings.HasPrefix(tag, "W/")
+
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(tag, "W/"))
+	if err != nil {
+		return 0, false, errors.Errorf("invalid entity tag %s", tag)
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false, errors.Errorf("invalid entity tag %s", tag)
+	}
+
+	return version, weak, nil
+}
+
+// expectedVersion returns test data version required by If-Match and
+// If-None-Match headers of a write request. If-Match uses strong comparison,
+// so a weak tag never matches and ErrVersionMismatch is returned.
+func expectedVersion(r *http.Request) (int64, error) {
+	if match := strings.TrimSpace(r.Header.Get("If-Match")); match != "" {
+		if match == "*" {
+			return ExistingVersion, nil
+		}
+
+		if strings.Contains(match, ",") {
+			return 0, errors.New("only a single entity tag is supported in If-Match")
+		}
+
+		version, weak, err := parseETag(match)
+		if err != nil {
+			return 0, err
+		}
+
+		if weak {
+			return 0, ErrVersionMismatch
+		}
+
+		return version, nil
+	}
+
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		return 0, nil
+	}
+
+	return AnyVersion, nil
+}
+
+// noneMatch checks whether If-None-Match header of a read request allows to
+// return data of provided version. Tags are compared weakly.
+func noneMatch(r *http.Request, version int64) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "" {
+		return true
+	}
+
+	if header == "*" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if v, _, err := parseETag(tag); err == nil && v == version {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,237 @@
+package runs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+)
+
+// FeedStrategy defines which row of a feed agent receives next.
+type FeedStrategy string
+
+// FeedStrategy... describes supported feed strategies.
+const (
+	// FeedSequential hands out rows in upload order shared by all agents,
+	// every row is received by a single agent only and the feed is exhausted
+	// once all rows are consumed.
+	FeedSequential FeedStrategy = "sequential"
+	// FeedRandom hands out random rows, rows may repeat.
+	FeedRandom FeedStrategy = "random"
+	// FeedCircular hands out rows in upload order shared by all agents,
+	// starting over after the last row.
+	FeedCircular FeedStrategy = "circular"
+	// FeedUnique hands out rows in random order shared by all agents, every
+	// row is received by a single agent only and the feed is exhausted once
+	// all rows are consumed.
+	FeedUnique FeedStrategy = "unique"
+)
+
+var (
+	// ErrInvalidFeed indicates that uploaded feed has no rows or is
+	// malformed.
+	ErrInvalidFeed = errors.New("invalid feed")
+	// ErrInvalidFeedStrategy indicates that feed strategy is not supported.
+	ErrInvalidFeedStrategy = errors.New("invalid feed strategy")
+	// ErrFeedNotFound indicates that feed does not exist.
+	ErrFeedNotFound = errors.New("feed not found")
+	// ErrFeedExhausted indicates that there are no unconsumed rows left.
+	ErrFeedExhausted = errors.New("feed is exhausted")
+)
+
+// FeedRow describes a row received by agent.
+type FeedRow struct {
+	Feed string `json:"feed"`
+	// Index is the position of the row in uploaded feed, starting from 0.
+	Index int             `json:"index"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// FeedStatus describes a feed in HTTP responses.
+type FeedStatus struct {
+	Name     string       `json:"name"`
+	Strategy FeedStrategy `json:"strategy"`
+	Rows     int          `json:"rows"`
+}
+
+// Feed describes a named dataset distributed to agents of a test row by row.
+type Feed struct {
+	Name     string
+	Strategy FeedStrategy
+	rows     []json.RawMessage
+	// order holds row indexes in order they are handed out by unique feeds.
+	order []int
+	// next is the position of the next row shared by all agents.
+	next int
+	mu   sync.Mutex
+}
+
+// NewFeed creates a feed of provided rows.
+func NewFeed(name string, strategy FeedStrategy, rows []json.RawMessage) *Feed {
+	feed := &Feed{Name: name, Strategy: strategy, rows: rows}
+
+	if strategy == FeedUnique {
+		feed.order = rand.Perm(len(rows))
+	}
+
+	return feed
+}
+
+// ParseFeedStrategy returns feed strategy by name, FeedSequential if name is
+// empty.
+func ParseFeedStrategy(name string) (FeedStrategy, error) {
+	switch strategy := FeedStrategy(name); strategy {
+	case "":
+		return FeedSequential, nil
+	case FeedSequential, FeedRandom, FeedCircular, FeedUnique:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrInvalidFeedStrategy, name)
+	}
+}
+
+// ParseCSVFeed parses CSV with a header line, every following line is a row
+// encoded as JSON object of header names to values.
+func ParseCSVFeed(data []byte) ([]json.RawMessage, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read CSV header: %s", ErrInvalidFeed, err)
+	}
+
+	var rows []json.RawMessage
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidFeed, err)
+		}
+
+		values := make(map[string]string, len(header))
+		for i, name := range header {
+			values[name] = record[i]
+		}
+
+		row, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: no rows", ErrInvalidFeed)
+	}
+
+	return rows, nil
+}
+
+// ParseJSONLinesFeed parses JSON lines, every non-empty line is a row.
+func ParseJSONLinesFeed(data []byte) ([]json.RawMessage, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxBodyBytes)
+
+	var rows []json.RawMessage
+	for line := 1; scanner.Scan(); line++ {
+		row := bytes.TrimSpace(scanner.Bytes())
+		if len(row) == 0 {
+			continue
+		}
+
+		if !json.Valid(row) {
+			return nil, fmt.Errorf("%w: line %d is not valid JSON", ErrInvalidFeed, line)
+		}
+
+		rows = append(rows, append(json.RawMessage{}, row...))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidFeed, err)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: no rows", ErrInvalidFeed)
+	}
+
+	return rows, nil
+}
+
+// Next returns the next row according to feed strategy.
+func (f *Feed) Next() (FeedRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var index int
+
+	switch f.Strategy {
+	case FeedRandom:
+		index = rand.IntN(len(f.rows))
+	case FeedCircular:
+		index = f.next
+		f.next = (f.next + 1) % len(f.rows)
+	default:
+		if f.next >= len(f.rows) {
+			return FeedRow{}, ErrFeedExhausted
+		}
+
+		index = f.next
+		if f.order != nil {
+			index = f.order[f.next]
+		}
+		f.next++
+	}
+
+	return FeedRow{Feed: f.Name, Index: index, Row: f.rows[index]}, nil
+}
+
+// Status returns feed status.
+func (f *Feed) Status() FeedStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return FeedStatus{Name: f.Name, Strategy: f.Strategy, Rows: len(f.rows)}
+}
+
+// SetFeed stores a feed, replacing existing one of the same name.
+func (t *Test) SetFeed(feed *Feed) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.feeds == nil {
+		t.feeds = make(map[string]*Feed)
+	}
+
+	t.feeds[feed.Name] = feed
+}
+
+// GetFeed returns a feed by name.
+func (t *Test) GetFeed(name string) (*Feed, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	feed, ok := t.feeds[name]
+	return feed, ok
+}
+
+// DeleteFeed removes a feed and reports whether it existed.
+func (t *Test) DeleteFeed(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.feeds[name]; !ok {
+		return false
+	}
+
+	delete(t.feeds, name)
+
+	return true
+}
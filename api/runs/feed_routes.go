@@ -0,0 +1,119 @@
+package runs
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	stderrors "errors"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerFeedRoutes registers routes of test feeds.
+func registerFeedRoutes(r *mux.Router) {
+	r.HandleFunc(`/feeds/{name}`, readFeedHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/feeds/{name}`, uploadFeedHandler).Methods(http.MethodPut)
+	r.HandleFunc(`/feeds/{name}`, deleteFeedHandler).Methods(http.MethodDelete)
+}
+
+func readFeedHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	t, ok := GetTest(testID)
+	if !ok {
+		utils.HTTPError(w, "Could not find feed", http.StatusNotFound)
+		return
+	}
+
+	feed, ok := t.GetFeed(name)
+	if !ok {
+		utils.HTTPError(w, "Could not find feed", http.StatusNotFound)
+		return
+	}
+
+	writeFeed(w, feed.Status())
+}
+
+// uploadFeedHandler stores a feed from CSV (Content-Type text/csv) or JSON
+// lines body. Strategy is set by optional strategy query param.
+func uploadFeedHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "feed": name})
+
+	strategy, err := ParseFeedStrategy(r.URL.Query().Get("strategy"))
+	if err != nil {
+		utils.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	var rows []json.RawMessage
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		rows, err = ParseCSVFeed(body)
+	} else {
+		rows, err = ParseJSONLinesFeed(body)
+	}
+	if err != nil {
+		if stderrors.Is(err, ErrInvalidFeed) {
+			utils.HTTPError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Errorf("Could not parse feed: %s", err.Error())
+		utils.HTTPError(w, "Could not parse feed", http.StatusInternalServerError)
+		return
+	}
+
+	feed := NewFeed(name, strategy, rows)
+	ensureTest(testID).SetFeed(feed)
+
+	logger.Info("Stored feed")
+
+	writeFeed(w, feed.Status())
+}
+
+func deleteFeedHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	t, ok := GetTest(testID)
+	if !ok || !t.DeleteFeed(name) {
+		utils.HTTPError(w, "Could not find feed", http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{"test_id": testID, "feed": name}).
+		Info("Deleted feed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeFeed(w http.ResponseWriter, status FeedStatus) {
+	resp, err := json.Marshal(status)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
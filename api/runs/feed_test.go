@@ -0,0 +1,104 @@
+package runs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseFeeds(t *testing.T) {
+	rows, err := ParseCSVFeed([]byte("user,password\nalice,secret\n\"bob, jr\",pass\n"))
+	if err != nil {
+		t.Fatalf("parse CSV failed: %v", err)
+	}
+
+	expected := []string{
+		`{"password":"secret","user":"alice"}`,
+		`{"password":"pass","user":"bob, jr"}`,
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("unexpected rows: %s", rows)
+	}
+	for i := range expected {
+		if string(rows[i]) != expected[i] {
+			t.Fatalf("unexpected row %d: %s", i, rows[i])
+		}
+	}
+
+	rows, err = ParseJSONLinesFeed([]byte("{\"user\":\"alice\"}\n\n  2  \n"))
+	if err != nil {
+		t.Fatalf("parse JSON lines failed: %v", err)
+	}
+	if len(rows) != 2 || string(rows[0]) != `{"user":"alice"}` || string(rows[1]) != `2` {
+		t.Fatalf("unexpected rows: %s", rows)
+	}
+
+	for _, data := range []string{"", "user\n", "user,password\nalice\n"} {
+		if _, err := ParseCSVFeed([]byte(data)); !errors.Is(err, ErrInvalidFeed) {
+			t.Fatalf("expected invalid CSV feed for %q, got %v", data, err)
+		}
+	}
+
+	for _, data := range []string{"", "\n", "{\"a\":1}\n{"} {
+		if _, err := ParseJSONLinesFeed([]byte(data)); !errors.Is(err, ErrInvalidFeed) {
+			t.Fatalf("expected invalid JSON lines feed for %q, got %v", data, err)
+		}
+	}
+
+	if _, err := ParseFeedStrategy("shuffle"); !errors.Is(err, ErrInvalidFeedStrategy) {
+		t.Fatalf("expected invalid strategy, got %v", err)
+	}
+}
+
+func TestFeedNext(t *testing.T) {
+	rows := []json.RawMessage{[]byte(`0`), []byte(`1`), []byte(`2`)}
+
+	next := func(feed *Feed) int {
+		t.Helper()
+
+		row, err := feed.Next()
+		if err != nil {
+			t.Fatalf("next row failed: %v", err)
+		}
+		if string(row.Row) != string(rows[row.Index]) || row.Feed != feed.Name {
+			t.Fatalf("unexpected row: %+v", row)
+		}
+
+		return row.Index
+	}
+
+	sequential := NewFeed("users", FeedSequential, rows)
+	for i := 0; i < 3; i++ {
+		if index := next(sequential); index != i {
+			t.Fatalf("expected row %d, got %d", i, index)
+		}
+	}
+	if _, err := sequential.Next(); !errors.Is(err, ErrFeedExhausted) {
+		t.Fatalf("expected exhausted feed, got %v", err)
+	}
+
+	circular := NewFeed("users", FeedCircular, rows)
+	for i := 0; i < 4; i++ {
+		if index := next(circular); index != i%3 {
+			t.Fatalf("expected row %d, got %d", i%3, index)
+		}
+	}
+
+	unique := NewFeed("users", FeedUnique, rows)
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		index := next(unique)
+		if seen[index] {
+			t.Fatalf("expected row %d to be received once", index)
+		}
+		seen[index] = true
+	}
+	if _, err := unique.Next(); !errors.Is(err, ErrFeedExhausted) {
+		t.Fatalf("expected exhausted feed, got %v", err)
+	}
+
+	random := NewFeed("users", FeedRandom, rows)
+	for i := 0; i < 10; i++ {
+		next(random)
+	}
+}
@@ -0,0 +1,156 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	stderrors "errors"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerKeyRoutes registers routes of named keys within a test.
+func registerKeyRoutes(r *mux.Router) {
+	r.HandleFunc(`/keys`, listKeysHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/keys/`, listKeysHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/keys/{key}`, readKeyHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/keys/{key}`, writeKeyHandler).Methods(http.MethodPut)
+	r.HandleFunc(`/keys/{key}`, deleteKeyHandler).Methods(http.MethodDelete)
+}
+
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	keys, err := DefaultService.ListKeys(testID)
+	if err != nil {
+		log.WithField("test_id", testID).
+			Errorf("Could not list keys: %s", err.Error())
+		utils.HTTPError(w, "Could not list keys", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(struct {
+		Keys []string `json:"keys"`
+	}{Keys: keys})
+	if err != nil {
+		utils.HTTPError(w, "Could not list keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
+
+func readKeyHandler(w http.ResponseWriter, r *http.Request) {
+	testID, key, ok := getPathKey(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "key": key})
+
+	data, version, err := DefaultService.ReadKey(testID, key)
+	if err != nil {
+		if stderrors.Is(err, ErrKeyNotFound) {
+			utils.HTTPError(w, "Could not find key", http.StatusNotFound)
+			return
+		}
+
+		logger.Errorf("Could not read key: %s", err.Error())
+		utils.HTTPError(w, "Could not read key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(version))
+
+	if !noneMatch(r, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeResponse(w, data, http.StatusOK)
+}
+
+func writeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	testID, key, ok := getPathKey(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "key": key})
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	expected, ok := getExpectedVersion(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := DefaultService.SetKey(testID, key, body, expected)
+	if err != nil {
+		if stderrors.Is(err, ErrVersionMismatch) {
+			utils.HTTPError(
+				w, "Key version does not match", http.StatusPreconditionFailed,
+			)
+			return
+		}
+
+		logger.Errorf("Could not store key: %s", err.Error())
+		utils.HTTPError(w, "Could not store key", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Stored key")
+
+	w.Header().Set("ETag", formatETag(version))
+	writeResponse(w, body, http.StatusOK)
+}
+
+func deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	testID, key, ok := getPathKey(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "key": key})
+
+	if err := DefaultService.DeleteKey(testID, key); err != nil {
+		if stderrors.Is(err, ErrKeyNotFound) {
+			utils.HTTPError(w, "Could not find key", http.StatusNotFound)
+			return
+		}
+
+		logger.Errorf("Could not delete key: %s", err.Error())
+		utils.HTTPError(w, "Could not delete key", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Deleted key")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPathKey returns validated test ID and key from path variables. In case
+// of invalid values, error response is written.
+func getPathKey(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return "", "", false
+	}
+
+	key, err := GetPathID(w, r, "key")
+	if err != nil {
+		return "", "", false
+	}
+
+	return testID, key, true
+}
@@ -0,0 +1,110 @@
+package runs
+
+import (
+	"errors"
+
+	"github.com/paulsgrudups/testsync/storage"
+)
+
+// DefaultKey names the key that holds the whole test data.
+const DefaultKey = storage.DefaultKey
+
+var (
+	// ErrInvalidKey indicates that provided key name is not valid.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrKeyNotFound indicates that key is not stored within test.
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// ValidateKey checks that key name follows the same rules as test IDs.
+func ValidateKey(key string) error {
+	if ValidateTestID(key) != nil {
+		return ErrInvalidKey
+	}
+
+	return nil
+}
+
+// ReadKey returns value of a named key with its version or ErrKeyNotFound.
+// DefaultKey refers to the whole test data.
+func (s *Service) ReadKey(testID, key string) ([]byte, int64, error) {
+	if key == DefaultKey {
+		data, version, err := s.ReadTestDataVersion(testID)
+		if errors.Is(err, ErrTestNotFound) {
+			return nil, 0, ErrKeyNotFound
+		}
+
+		return data, version, err
+	}
+
+	data, version, ok, err := s.store().LoadKey(testID, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	return data, version, nil
+}
+
+// SetKey stores value of a named key and returns its new version. Expected
+// version is checked and watchers are notified the same way as in
+// UpdateTestDataIfVersion.
+func (s *Service) SetKey(
+	testID, key string, data []byte, expected int64,
+) (int64, error) {
+	if key == DefaultKey {
+		return s.UpdateTestDataIfVersion(testID, data, expected)
+	}
+
+	if expected == ExistingVersion {
+		_, current, ok, err := s.store().LoadKey(testID, key)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrVersionMismatch
+		}
+
+		expected = current
+	}
+
+	version, err := s.store().CompareAndSaveKey(testID, key, data, expected)
+	if err != nil {
+		return 0, err
+	}
+
+	notifyDataChanged(testID, key, data, version)
+
+	return version, nil
+}
+
+// DeleteKey removes a named key or returns ErrKeyNotFound. Deleting
+// DefaultKey removes test data, but keeps other keys and connections.
+func (s *Service) DeleteKey(testID, key string) error {
+	deleted, err := s.store().DeleteKey(testID, key)
+	if err != nil {
+		return err
+	}
+
+	if key == DefaultKey {
+		if t, ok := GetTest(testID); ok && len(t.GetData()) > 0 {
+			t.SetData(nil)
+			deleted = true
+		}
+	}
+
+	if !deleted {
+		return ErrKeyNotFound
+	}
+
+	notifyKeyDeleted(testID, key)
+
+	return nil
+}
+
+// ListKeys returns sorted names of keys stored within test.
+func (s *Service) ListKeys(testID string) ([]string, error) {
+	return s.store().ListKeys(testID)
+}
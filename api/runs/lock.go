@@ -0,0 +1,259 @@
+package runs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Message... describes messages pushed to lock holders and waiters.
+const (
+	MessageLockGranted = "lock_granted"
+	MessageLockExpired = "lock_expired"
+)
+
+var (
+	// ErrLockConflict indicates that agent already holds or waits for lock.
+	ErrLockConflict = errors.New("agent already holds or waits for lock")
+	// ErrLockNotHeld indicates that agent neither holds nor waits for lock.
+	ErrLockNotHeld = errors.New("lock is not held by agent")
+)
+
+// LockRequest describes an agent holding or waiting for a lock.
+type LockRequest struct {
+	Waiter
+	// TTL limits how long the lock is held once granted. Zero disables the
+	// lease.
+	TTL time.Duration
+}
+
+// Lock describes a named mutex shared by agents of a test. Waiters obtain the
+// lock in FIFO order.
+type Lock struct {
+	Name    string
+	holder  *LockRequest
+	waiters []LockRequest
+	lease   *time.Timer
+	// holds counts granted holds so an outdated lease does not release the
+	// lock of the next holder.
+	holds uint64
+	t     *Test
+	mu    sync.Mutex
+}
+
+// NewLock creates a lock for provided test.
+func NewLock(name string, t *Test) *Lock {
+	return &Lock{Name: name, t: t}
+}
+
+// Acquire grants lock to agent if it's free, otherwise agent is queued. Agent
+// receives lock_granted message once it holds the lock.
+func (l *Lock) Acquire(req LockRequest) error {
+	l.mu.Lock()
+
+	if l.holder != nil && l.holder.AgentID == req.AgentID {
+		l.mu.Unlock()
+		return ErrLockConflict
+	}
+
+	for _, waiter := range l.waiters {
+		if waiter.AgentID == req.AgentID {
+			l.mu.Unlock()
+			return ErrLockConflict
+		}
+	}
+
+	if l.holder != nil {
+		l.waiters = append(l.waiters, req)
+		l.mu.Unlock()
+
+		return nil
+	}
+
+	l.grant(req)
+	l.mu.Unlock()
+
+	l.notify(&req, MessageLockGranted)
+
+	return nil
+}
+
+// Release releases lock held by agent and grants it to the next waiter. If
+// agent is only waiting for the lock, it leaves the queue.
+func (l *Lock) Release(agentID string) error {
+	l.mu.Lock()
+
+	if l.holder != nil && l.holder.AgentID == agentID {
+		granted := l.next()
+		l.mu.Unlock()
+
+		l.notify(granted, MessageLockGranted)
+
+		return nil
+	}
+
+	defer l.mu.Unlock()
+
+	for i, waiter := range l.waiters {
+		if waiter.AgentID == agentID {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrLockNotHeld
+}
+
+// Holder returns ID of agent holding the lock, empty if lock is free.
+func (l *Lock) Holder() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder == nil {
+		return ""
+	}
+
+	return l.holder.AgentID
+}
+
+// Waiters returns IDs of agents waiting for the lock in order they will be
+// granted it.
+func (l *Lock) Waiters() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := make([]string, len(l.waiters))
+	for i, waiter := range l.waiters {
+		ids[i] = waiter.AgentID
+	}
+
+	return ids
+}
+
+// Stop stops lease of the current holder.
+func (l *Lock) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lease != nil {
+		l.lease.Stop()
+	}
+}
+
+// grant makes req the lock holder and starts its lease. Must be called with
+// l.mu held.
+func (l *Lock) grant(req LockRequest) {
+	l.holder = &req
+	l.holds++
+
+	if req.TTL <= 0 {
+		return
+	}
+
+	holds := l.holds
+	l.lease = time.AfterFunc(req.TTL, func() { l.expire(holds) })
+}
+
+// next releases lock from the current holder and grants it to the first
+// waiter, which is returned so it can be notified. Must be called with l.mu
+// held.
+func (l *Lock) next() *LockRequest {
+	if l.lease != nil {
+		l.lease.Stop()
+		l.lease = nil
+	}
+
+	l.holder = nil
+
+	if len(l.waiters) == 0 {
+		return nil
+	}
+
+	waiter := l.waiters[0]
+	l.waiters = l.waiters[1:]
+	l.grant(waiter)
+
+	return &waiter
+}
+
+// expire releases lock once lease of a hold has passed.
+func (l *Lock) expire(holds uint64) {
+	l.mu.Lock()
+	if l.holds != holds || l.holder == nil {
+		l.mu.Unlock()
+		return
+	}
+
+	log.Debugf("Lease of lock %q expired", l.Name)
+
+	expired := l.holder
+	granted := l.next()
+	l.mu.Unlock()
+
+	l.notify(expired, MessageLockExpired)
+	l.notify(granted, MessageLockGranted)
+}
+
+// notify sends lock message to agent, if any.
+func (l *Lock) notify(req *LockRequest, command string) {
+	if req == nil {
+		return
+	}
+
+	agent := l.t.GetConnection(req.AgentID)
+	if agent == nil {
+		return
+	}
+
+	err := agent.Reply(req.RequestID, command, struct {
+		Name string `json:"name"`
+	}{Name: l.Name})
+	if err != nil {
+		log.Errorf("Could not notify agent %q about lock %q: %s",
+			req.AgentID, l.Name, err.Error())
+	}
+}
+
+// EnsureLock gets or creates a named lock.
+func (t *Test) EnsureLock(name string) *Lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l, ok := t.Locks[name]; ok {
+		return l
+	}
+
+	if t.Locks == nil {
+		t.Locks = make(map[string]*Lock)
+	}
+
+	l := NewLock(name, t)
+	t.Locks[name] = l
+
+	return l
+}
+
+// GetLock returns a lock by name.
+func (t *Test) GetLock(name string) (*Lock, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	l, ok := t.Locks[name]
+	return l, ok
+}
+
+// releaseLocks releases locks held by agent and removes it from waiters.
+func (t *Test) releaseLocks(agentID string) {
+	t.mu.RLock()
+	locks := make([]*Lock, 0, len(t.Locks))
+	for _, l := range t.Locks {
+		locks = append(locks, l)
+	}
+	t.mu.RUnlock()
+
+	for _, l := range locks {
+		l.Release(agentID) // nolint: errcheck, gosec
+	}
+}
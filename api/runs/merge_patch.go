@@ -0,0 +1,61 @@
+package runs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// applyMergePatch applies JSON Merge Patch (RFC 7396) to target document.
+// Empty target is treated as null.
+func applyMergePatch(target, patch []byte) ([]byte, error) {
+	var patchDoc interface{}
+	if err := decodeJSON(patch, &patchDoc); err != nil {
+		return nil, ErrInvalidPatch
+	}
+
+	var targetDoc interface{}
+	if len(bytes.TrimSpace(target)) > 0 {
+		if err := decodeJSON(target, &targetDoc); err != nil {
+			return nil, ErrDataNotJSON
+		}
+	}
+
+	return json.Marshal(mergePatch(targetDoc, patchDoc))
+}
+
+// mergePatch implements MergePatch function as described in RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{}, len(patchObj))
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+
+	return targetObj
+}
+
+// decodeJSON decodes a single JSON document keeping numbers as is.
+func decodeJSON(data []byte, v interface{}) error {
+	if !json.Valid(data) {
+		return errors.New("invalid JSON document")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
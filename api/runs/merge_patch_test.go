@@ -0,0 +1,54 @@
+package runs
+
+import "testing"
+
+func TestApplyMergePatch(t *testing.T) {
+	// examples from RFC 7396 appendix A.
+	cases := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{``, `{"a":1}`, `{"a":1}`},
+		{`{"n":12345678901234567890}`, `{}`, `{"n":12345678901234567890}`},
+	}
+
+	for _, tc := range cases {
+		got, err := applyMergePatch([]byte(tc.target), []byte(tc.patch))
+		if err != nil {
+			t.Fatalf("patch %s to %s failed: %v", tc.patch, tc.target, err)
+		}
+
+		if string(got) != tc.want {
+			t.Fatalf(
+				"patch %s to %s: expected %s, got %s",
+				tc.patch, tc.target, tc.want, string(got),
+			)
+		}
+	}
+}
+
+func TestApplyMergePatch_Errors(t *testing.T) {
+	if _, err := applyMergePatch([]byte(`{}`), []byte(`{`)); err != ErrInvalidPatch {
+		t.Fatalf("expected ErrInvalidPatch, got %v", err)
+	}
+
+	if _, err := applyMergePatch([]byte(`raw`), []byte(`{}`)); err != ErrDataNotJSON {
+		t.Fatalf("expected ErrDataNotJSON, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package runs
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageDirect is pushed to agent once another agent sends it a message.
+const MessageDirect = "message"
+
+// DirectMessage describes content of message pushed to the target agent.
+type DirectMessage struct {
+	SenderID string `json:"sender_id"`
+	// SenderRole is set if sender holds a role.
+	SenderRole *RoleAssignment `json:"sender_role,omitempty"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// MessageTarget addresses agents by agent ID or by role. Role without ordinal
+// addresses all agents holding it.
+type MessageTarget struct {
+	AgentID string `json:"agent_id,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Ordinal *int   `json:"ordinal,omitempty"`
+}
+
+// Targets returns IDs of agents addressed by target.
+func (t *Test) Targets(target MessageTarget) []string {
+	if target.AgentID != "" {
+		return []string{target.AgentID}
+	}
+
+	members := t.RoleMembers(target.Role)
+	if target.Ordinal == nil {
+		return members
+	}
+
+	for _, agentID := range members {
+		if assignment, ok := t.AgentRole(agentID); ok &&
+			assignment.Ordinal == *target.Ordinal {
+			return []string{agentID}
+		}
+	}
+
+	return nil
+}
+
+// SendTo pushes a message from sender to agents addressed by target and
+// returns IDs of agents it was sent to. Agents without an active connection
+// are skipped, ErrAgentNotConnected is returned if none is connected.
+func (t *Test) SendTo(
+	senderID string, target MessageTarget, data json.RawMessage,
+) ([]string, error) {
+	msg := DirectMessage{SenderID: senderID, Data: data}
+	if assignment, ok := t.AgentRole(senderID); ok {
+		msg.SenderRole = &assignment
+	}
+
+	var delivered []string
+	for _, agentID := range t.Targets(target) {
+		agent := t.GetConnection(agentID)
+		if agent == nil || !agent.Connected() {
+			continue
+		}
+
+		if err := agent.Send(MessageDirect, msg); err != nil {
+			log.Errorf("Could not send message from agent %q to %q: %s",
+				senderID, agentID, err.Error())
+			continue
+		}
+
+		delivered = append(delivered, agentID)
+	}
+
+	if len(delivered) == 0 {
+		return nil, ErrAgentNotConnected
+	}
+
+	return delivered, nil
+}
@@ -0,0 +1,265 @@
+package runs
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/paulsgrudups/testsync/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageLeaseExpired is pushed to agent once lease of a pool item expires.
+const MessageLeaseExpired = "lease_expired"
+
+// GlobalPool is the test ID under which global pools are stored.
+const GlobalPool = ""
+
+var (
+	// ErrInvalidPool indicates that uploaded pool is not a non-empty JSON
+	// array.
+	ErrInvalidPool = errors.New("pool must be a non-empty JSON array")
+	// ErrPoolNotFound indicates that pool does not exist.
+	ErrPoolNotFound = errors.New("pool not found")
+	// ErrPoolExhausted indicates that all items of a pool are leased.
+	ErrPoolExhausted = errors.New("all pool items are leased")
+	// ErrLeaseNotFound indicates that lease is not active.
+	ErrLeaseNotFound = errors.New("lease not found")
+)
+
+// LeaseRequest describes an agent leasing a pool item.
+type LeaseRequest struct {
+	Waiter
+	TestID string
+	// TTL limits how long the item is leased. Zero disables the lease
+	// expiry.
+	TTL time.Duration
+}
+
+// PoolLease describes an item leased to agent.
+type PoolLease struct {
+	Pool    string          `json:"pool"`
+	Global  bool            `json:"global,omitempty"`
+	LeaseID string          `json:"lease_id"`
+	ItemID  int64           `json:"item_id"`
+	Item    json.RawMessage `json:"item,omitempty"`
+	// ExpiresAt is lease expiry in unix milliseconds, omitted without TTL.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// PoolItemStatus describes a pool item in HTTP responses.
+type PoolItemStatus struct {
+	ID        int64           `json:"id"`
+	Item      json.RawMessage `json:"item"`
+	Leased    bool            `json:"leased"`
+	LeaseID   string          `json:"lease_id,omitempty"`
+	TestID    string          `json:"test_id,omitempty"`
+	AgentID   string          `json:"agent_id,omitempty"`
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+}
+
+// PoolStatus describes items of a pool and their leases.
+type PoolStatus struct {
+	Name  string           `json:"name"`
+	Free  int              `json:"free"`
+	Items []PoolItemStatus `json:"items"`
+}
+
+// ParsePoolItems parses uploaded pool, a non-empty JSON array of items.
+func ParsePoolItems(data []byte) ([][]byte, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) == 0 {
+		return nil, ErrInvalidPool
+	}
+
+	items := make([][]byte, len(raw))
+	for i, item := range raw {
+		items[i] = item
+	}
+
+	return items, nil
+}
+
+// SavePool replaces items of a pool, dropping existing leases. Pools of
+// GlobalPool test ID are shared by all tests.
+func (s *Service) SavePool(poolTestID, name string, items [][]byte) error {
+	return s.store().SavePool(poolTestID, name, items)
+}
+
+// ReadPool returns items of a pool with their leases or ErrPoolNotFound.
+func (s *Service) ReadPool(poolTestID, name string) (PoolStatus, error) {
+	items, err := s.store().LoadPool(poolTestID, name)
+	if err != nil {
+		return PoolStatus{}, err
+	}
+	if len(items) == 0 {
+		return PoolStatus{}, ErrPoolNotFound
+	}
+
+	now := time.Now()
+	status := PoolStatus{Name: name, Items: make([]PoolItemStatus, len(items))}
+
+	for i, item := range items {
+		status.Items[i] = PoolItemStatus{ID: item.ID, Item: item.Data}
+
+		if !item.Leased(now) {
+			status.Free++
+			continue
+		}
+
+		status.Items[i].Leased = true
+		status.Items[i].LeaseID = item.LeaseID
+		status.Items[i].TestID = item.HolderTestID
+		status.Items[i].AgentID = item.HolderAgentID
+		status.Items[i].ExpiresAt = item.Expires
+	}
+
+	return status, nil
+}
+
+// DeletePool removes a pool or returns ErrPoolNotFound.
+func (s *Service) DeletePool(poolTestID, name string) error {
+	deleted, err := s.store().DeletePool(poolTestID, name)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPoolNotFound
+	}
+
+	return nil
+}
+
+// LeaseItem leases the first free item of a pool to agent. Once lease TTL
+// passes, item is returned to the pool and agent receives lease_expired
+// message.
+func (s *Service) LeaseItem(
+	poolTestID, name string, req LeaseRequest,
+) (PoolLease, error) {
+	lease := storage.PoolItem{
+		LeaseID:       NewLeaseID(),
+		HolderTestID:  req.TestID,
+		HolderAgentID: req.AgentID,
+	}
+	if req.TTL > 0 {
+		lease.Expires = time.Now().Add(req.TTL).UnixMilli()
+	}
+
+	item, ok, err := s.store().LeasePoolItem(poolTestID, name, lease)
+	if err != nil {
+		return PoolLease{}, err
+	}
+
+	if !ok {
+		items, err := s.store().LoadPool(poolTestID, name)
+		if err != nil {
+			return PoolLease{}, err
+		}
+		if len(items) == 0 {
+			return PoolLease{}, ErrPoolNotFound
+		}
+
+		return PoolLease{}, ErrPoolExhausted
+	}
+
+	leased := PoolLease{
+		Pool:      name,
+		Global:    poolTestID == GlobalPool,
+		LeaseID:   item.LeaseID,
+		ItemID:    item.ID,
+		Item:      item.Data,
+		ExpiresAt: item.Expires,
+	}
+
+	if req.TTL > 0 {
+		time.AfterFunc(req.TTL, func() {
+			s.expireLease(poolTestID, leased, req)
+		})
+	}
+
+	return leased, nil
+}
+
+// ReturnItem returns leased item to the pool or returns ErrLeaseNotFound.
+func (s *Service) ReturnItem(poolTestID, name, leaseID string) error {
+	returned, err := s.store().ReturnPoolItem(poolTestID, name, leaseID)
+	if err != nil {
+		return err
+	}
+	if !returned {
+		return ErrLeaseNotFound
+	}
+
+	return nil
+}
+
+// ReturnLeases returns all items leased by agent of a test.
+func (s *Service) ReturnLeases(testID, agentID string) error {
+	return s.store().ReturnPoolItems(testID, agentID)
+}
+
+// expireLease returns item once its lease has passed and notifies holder,
+// unless item was returned or leased again already.
+func (s *Service) expireLease(poolTestID string, lease PoolLease, req LeaseRequest) {
+	items, err := s.store().LoadPool(poolTestID, lease.Pool)
+	if err != nil {
+		log.Errorf("Could not load pool %q: %s", lease.Pool, err.Error())
+		return
+	}
+
+	active := false
+	for _, item := range items {
+		if item.LeaseID == lease.LeaseID {
+			active = true
+			break
+		}
+	}
+
+	if !active {
+		return
+	}
+
+	// lease has passed, so it's no longer reported as returned.
+	_, err = s.store().ReturnPoolItem(poolTestID, lease.Pool, lease.LeaseID)
+	if err != nil {
+		log.Errorf("Could not return item of pool %q: %s", lease.Pool, err.Error())
+		return
+	}
+
+	log.Debugf("Lease of pool %q item %d expired", lease.Pool, lease.ItemID)
+
+	t, ok := GetTest(req.TestID)
+	if !ok {
+		return
+	}
+
+	agent := t.GetConnection(req.AgentID)
+	if agent == nil {
+		return
+	}
+
+	lease.Item = nil
+
+	if err := agent.Reply(req.RequestID, MessageLeaseExpired, lease); err != nil {
+		log.Errorf("Could not notify agent %q about lease of pool %q: %s",
+			req.AgentID, lease.Pool, err.Error())
+	}
+}
+
+// NewLeaseID generates a random lease ID.
+func NewLeaseID() string {
+	return randomHex(16)
+}
+
+// returnLeases returns items leased by agent. Tests created without a service
+// hold no leases.
+func (t *Test) returnLeases(agentID string) {
+	if t.id == "" || t.service == nil {
+		return
+	}
+
+	if err := t.service.ReturnLeases(t.id, agentID); err != nil {
+		log.Errorf("Could not return items leased by agent %q: %s",
+			agentID, err.Error())
+	}
+}
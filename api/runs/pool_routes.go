@@ -0,0 +1,162 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	stderrors "errors"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/api/auth"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegisterPoolRoutes registers routes of global resource pools.
+func RegisterPoolRoutes(r *mux.Router) {
+	subrouter := r.PathPrefix(`/pools`).Subrouter().StrictSlash(false)
+
+	subrouter.Use(auth.BasicAuthMiddleware(auth.NewValidator(SyncClient)))
+
+	registerPoolRoutes(subrouter, ``)
+}
+
+// registerPoolRoutes registers routes of resource pools under prefix.
+func registerPoolRoutes(r *mux.Router, prefix string) {
+	r.HandleFunc(prefix+`/{name}`, readPoolHandler).Methods(http.MethodGet)
+	r.HandleFunc(prefix+`/{name}`, savePoolHandler).Methods(http.MethodPut)
+	r.HandleFunc(prefix+`/{name}`, deletePoolHandler).Methods(http.MethodDelete)
+	r.HandleFunc(prefix+`/{name}/leases/{leaseID}`, returnItemHandler).
+		Methods(http.MethodDelete)
+}
+
+func readPoolHandler(w http.ResponseWriter, r *http.Request) {
+	poolTestID, name, ok := getPathPool(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := DefaultService.ReadPool(poolTestID, name)
+	if err != nil {
+		poolError(w, poolTestID, name, err)
+		return
+	}
+
+	writePool(w, status)
+}
+
+func savePoolHandler(w http.ResponseWriter, r *http.Request) {
+	poolTestID, name, ok := getPathPool(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": poolTestID, "pool": name})
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	items, err := ParsePoolItems(body)
+	if err != nil {
+		utils.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := DefaultService.SavePool(poolTestID, name, items); err != nil {
+		logger.Errorf("Could not store pool: %s", err.Error())
+		utils.HTTPError(w, "Could not store pool", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Stored pool")
+
+	status, err := DefaultService.ReadPool(poolTestID, name)
+	if err != nil {
+		poolError(w, poolTestID, name, err)
+		return
+	}
+
+	writePool(w, status)
+}
+
+func deletePoolHandler(w http.ResponseWriter, r *http.Request) {
+	poolTestID, name, ok := getPathPool(w, r)
+	if !ok {
+		return
+	}
+
+	if err := DefaultService.DeletePool(poolTestID, name); err != nil {
+		poolError(w, poolTestID, name, err)
+		return
+	}
+
+	log.WithFields(log.Fields{"test_id": poolTestID, "pool": name}).
+		Info("Deleted pool")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// returnItemHandler returns a leased item to the pool, e.g. one held by an
+// agent that is gone after server restart.
+func returnItemHandler(w http.ResponseWriter, r *http.Request) {
+	poolTestID, name, ok := getPathPool(w, r)
+	if !ok {
+		return
+	}
+
+	leaseID, err := GetPathID(w, r, "leaseID")
+	if err != nil {
+		return
+	}
+
+	if err := DefaultService.ReturnItem(poolTestID, name, leaseID); err != nil {
+		poolError(w, poolTestID, name, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// poolError writes error response for failed pool operation.
+func poolError(w http.ResponseWriter, poolTestID, name string, err error) {
+	switch {
+	case stderrors.Is(err, ErrPoolNotFound):
+		utils.HTTPError(w, "Could not find pool", http.StatusNotFound)
+	case stderrors.Is(err, ErrLeaseNotFound):
+		utils.HTTPError(w, "Could not find lease", http.StatusNotFound)
+	default:
+		log.WithFields(log.Fields{"test_id": poolTestID, "pool": name}).
+			Errorf("Could not process pool: %s", err.Error())
+		utils.HTTPError(w, "Could not process pool", http.StatusInternalServerError)
+	}
+}
+
+func writePool(w http.ResponseWriter, status PoolStatus) {
+	resp, err := json.Marshal(status)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode pool", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
+
+// getPathPool returns test ID of a pool and its name from path variables.
+// Global pools have GlobalPool test ID. In case of invalid values, error
+// response is written.
+func getPathPool(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	if _, ok := mux.Vars(r)["testID"]; ok {
+		return getPathName(w, r)
+	}
+
+	name, err := GetPathID(w, r, "name")
+	if err != nil {
+		return "", "", false
+	}
+
+	return GlobalPool, name, true
+}
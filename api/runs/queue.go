@@ -0,0 +1,294 @@
+package runs
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageQueuePop is sent to agent once it receives a task or its queue_pop
+// request times out.
+const MessageQueuePop = "queue_pop"
+
+// ErrTaskNotFound indicates that task is not delivered to agent or was
+// already acknowledged.
+var ErrTaskNotFound = errors.New("task not found")
+
+// QueueTask describes a task of a work queue.
+type QueueTask struct {
+	Queue  string          `json:"queue"`
+	TaskID int64           `json:"task_id"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	// TimedOut is set instead of task when no task arrived in time.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// QueueStatus describes number of tasks of a work queue.
+type QueueStatus struct {
+	Name     string `json:"name"`
+	Pending  int    `json:"pending"`
+	InFlight int    `json:"in_flight"`
+	Waiting  int    `json:"waiting"`
+}
+
+// PopRequest describes an agent waiting for a task.
+type PopRequest struct {
+	Waiter
+	// Timeout limits how long agent waits for a task. Zero waits until a
+	// task is pushed.
+	Timeout time.Duration
+}
+
+type queueWaiter struct {
+	PopRequest
+	timer *time.Timer
+}
+
+// delivery describes a task handed to a waiting agent.
+type delivery struct {
+	waiter *queueWaiter
+	task   QueueTask
+}
+
+type inFlightTask struct {
+	task    QueueTask
+	agentID string
+}
+
+// Queue describes a named work queue shared by agents of a test. Tasks are
+// delivered in FIFO order and stay in flight until acknowledged, tasks that
+// are not acknowledged are queued again once the consuming agent is removed
+// from the test.
+type Queue struct {
+	Name     string
+	pending  []QueueTask
+	inFlight map[int64]inFlightTask
+	waiters  []*queueWaiter
+	lastID   int64
+	t        *Test
+	mu       sync.Mutex
+}
+
+// NewQueue creates a work queue for provided test.
+func NewQueue(name string, t *Test) *Queue {
+	return &Queue{Name: name, inFlight: make(map[int64]inFlightTask), t: t}
+}
+
+// Push adds a task to the queue and returns it. Task is delivered right away
+// if an agent is waiting for one.
+func (q *Queue) Push(data json.RawMessage) QueueTask {
+	q.mu.Lock()
+	q.lastID++
+	task := QueueTask{Queue: q.Name, TaskID: q.lastID, Data: data}
+	q.pending = append(q.pending, task)
+	delivered := q.deliver()
+	q.mu.Unlock()
+
+	q.notify(delivered)
+
+	return task
+}
+
+// Pop delivers the first pending task to agent. If there is none, agent waits
+// for one until timeout passes. Agent receives queue_pop message with the
+// task or with timed_out set.
+func (q *Queue) Pop(req PopRequest) {
+	waiter := &queueWaiter{PopRequest: req}
+
+	q.mu.Lock()
+	q.waiters = append(q.waiters, waiter)
+	delivered := q.deliver()
+
+	if len(delivered) == 0 && req.Timeout > 0 {
+		waiter.timer = time.AfterFunc(req.Timeout, func() { q.timeout(waiter) })
+	}
+	q.mu.Unlock()
+
+	q.notify(delivered)
+}
+
+// Ack acknowledges a task delivered to agent, removing it from the queue.
+func (q *Queue) Ack(agentID string, taskID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	task, ok := q.inFlight[taskID]
+	if !ok || task.agentID != agentID {
+		return ErrTaskNotFound
+	}
+
+	delete(q.inFlight, taskID)
+
+	return nil
+}
+
+// Status returns number of pending and in flight tasks and waiting agents.
+func (q *Queue) Status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStatus{
+		Name:     q.Name,
+		Pending:  len(q.pending),
+		InFlight: len(q.inFlight),
+		Waiting:  len(q.waiters),
+	}
+}
+
+// Stop stops timeouts of waiting agents.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, waiter := range q.waiters {
+		if waiter.timer != nil {
+			waiter.timer.Stop()
+		}
+	}
+}
+
+// requeue puts tasks delivered to agent back to the front of the queue in
+// order they were pushed and stops agent waiting for tasks.
+func (q *Queue) requeue(agentID string) {
+	q.mu.Lock()
+
+	var tasks []QueueTask
+	for id, task := range q.inFlight {
+		if task.agentID == agentID {
+			tasks = append(tasks, task.task)
+			delete(q.inFlight, id)
+		}
+	}
+
+	if len(tasks) > 0 {
+		log.Debugf("Queueing %d tasks of agent %q again", len(tasks), agentID)
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].TaskID < tasks[j].TaskID
+		})
+		q.pending = append(tasks, q.pending...)
+	}
+
+	waiters := q.waiters[:0]
+	for _, waiter := range q.waiters {
+		if waiter.AgentID != agentID {
+			waiters = append(waiters, waiter)
+			continue
+		}
+
+		if waiter.timer != nil {
+			waiter.timer.Stop()
+		}
+	}
+	q.waiters = waiters
+
+	delivered := q.deliver()
+	q.mu.Unlock()
+
+	q.notify(delivered)
+}
+
+// deliver hands pending tasks to waiting agents and returns the deliveries so
+// agents can be notified. Must be called with q.mu held.
+func (q *Queue) deliver() []delivery {
+	var delivered []delivery
+
+	for len(q.pending) > 0 && len(q.waiters) > 0 {
+		task, waiter := q.pending[0], q.waiters[0]
+		q.pending, q.waiters = q.pending[1:], q.waiters[1:]
+
+		if waiter.timer != nil {
+			waiter.timer.Stop()
+		}
+
+		q.inFlight[task.TaskID] = inFlightTask{task: task, agentID: waiter.AgentID}
+		delivered = append(delivered, delivery{waiter: waiter, task: task})
+	}
+
+	return delivered
+}
+
+// timeout stops waiter from waiting for a task, unless it already got one.
+func (q *Queue) timeout(waiter *queueWaiter) {
+	q.mu.Lock()
+	found := false
+	for i, w := range q.waiters {
+		if w == waiter {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			found = true
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	if !found {
+		return
+	}
+
+	q.notify([]delivery{
+		{waiter: waiter, task: QueueTask{Queue: q.Name, TimedOut: true}},
+	})
+}
+
+// notify sends delivered tasks to agents. Tasks of agents that are gone are
+// queued again.
+func (q *Queue) notify(delivered []delivery) {
+	for _, d := range delivered {
+		agent := q.t.GetConnection(d.waiter.AgentID)
+		if agent == nil {
+			q.requeue(d.waiter.AgentID)
+			continue
+		}
+
+		err := agent.Reply(d.waiter.RequestID, MessageQueuePop, d.task)
+		if err != nil {
+			log.Errorf("Could not deliver task of queue %q to agent %q: %s",
+				q.Name, d.waiter.AgentID, err.Error())
+		}
+	}
+}
+
+// EnsureQueue gets or creates a named work queue.
+func (t *Test) EnsureQueue(name string) *Queue {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if q, ok := t.Queues[name]; ok {
+		return q
+	}
+
+	if t.Queues == nil {
+		t.Queues = make(map[string]*Queue)
+	}
+
+	q := NewQueue(name, t)
+	t.Queues[name] = q
+
+	return q
+}
+
+// GetQueue returns a work queue by name.
+func (t *Test) GetQueue(name string) (*Queue, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	q, ok := t.Queues[name]
+	return q, ok
+}
+
+// requeueTasks queues tasks delivered to agent again.
+func (t *Test) requeueTasks(agentID string) {
+	t.mu.RLock()
+	queues := make([]*Queue, 0, len(t.Queues))
+	for _, q := range t.Queues {
+		queues = append(queues, q)
+	}
+	t.mu.RUnlock()
+
+	for _, q := range queues {
+		q.requeue(agentID)
+	}
+}
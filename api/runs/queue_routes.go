@@ -0,0 +1,73 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// registerQueueRoutes registers routes of test work queues.
+func registerQueueRoutes(r *mux.Router) {
+	r.HandleFunc(`/queues/{name}`, readQueueHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/queues/{name}`, pushTaskHandler).Methods(http.MethodPost)
+}
+
+func readQueueHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	status := QueueStatus{Name: name}
+
+	if t, ok := GetTest(testID); ok {
+		if q, ok := t.GetQueue(name); ok {
+			status = q.Status()
+		}
+	}
+
+	writeQueueResponse(w, status)
+}
+
+// pushTaskHandler pushes request body, a JSON document, as a task to the
+// queue.
+func pushTaskHandler(w http.ResponseWriter, r *http.Request) {
+	testID, name, ok := getPathName(w, r)
+	if !ok {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"test_id": testID, "queue": name})
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	if !json.Valid(body) {
+		utils.HTTPError(w, "Task must be a JSON document", http.StatusBadRequest)
+		return
+	}
+
+	task := ensureTest(testID).EnsureQueue(name).Push(body)
+
+	logger.Debugf("Pushed task %d", task.TaskID)
+
+	task.Data = nil
+	writeQueueResponse(w, task)
+}
+
+func writeQueueResponse(w http.ResponseWriter, content interface{}) {
+	resp, err := json.Marshal(content)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode queue", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
@@ -0,0 +1,93 @@
+package runs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	stderrors "errors"
+
+	"github.com/gorilla/mux"
+	"github.com/paulsgrudups/testsync/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// RolesStatus describes role definitions and assignments of a test.
+type RolesStatus struct {
+	Roles       []RoleDefinition          `json:"roles"`
+	Assignments map[string]RoleAssignment `json:"assignments"`
+}
+
+// registerRoleRoutes registers routes of test roles.
+func registerRoleRoutes(r *mux.Router) {
+	r.HandleFunc(`/roles`, readRolesHandler).Methods(http.MethodGet)
+	r.HandleFunc(`/roles`, defineRolesHandler).Methods(http.MethodPut)
+}
+
+func readRolesHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	status := RolesStatus{
+		Roles:       []RoleDefinition{},
+		Assignments: map[string]RoleAssignment{},
+	}
+
+	if t, ok := GetTest(testID); ok {
+		status.Roles, status.Assignments = t.GetRoles()
+	}
+
+	writeRoles(w, status)
+}
+
+func defineRolesHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	logger := log.WithField("test_id", testID)
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	defs, err := ParseRoleDefinitions(body)
+	if err != nil {
+		utils.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := ensureTest(testID)
+	if err := t.SetRoles(defs); err != nil {
+		if stderrors.Is(err, ErrRolesAssigned) {
+			utils.HTTPError(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		logger.Errorf("Could not define roles: %s", err.Error())
+		utils.HTTPError(w, "Could not define roles", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Defined roles for test")
+
+	status := RolesStatus{}
+	status.Roles, status.Assignments = t.GetRoles()
+
+	writeRoles(w, status)
+}
+
+func writeRoles(w http.ResponseWriter, status RolesStatus) {
+	resp, err := json.Marshal(status)
+	if err != nil {
+		utils.HTTPError(w, "Could not encode roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, resp, http.StatusOK)
+}
@@ -0,0 +1,267 @@
+package runs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// RoleAny is the role count that does not limit number of agents.
+const RoleAny = "*"
+
+var (
+	// ErrInvalidRoles indicates that role definitions are malformed.
+	ErrInvalidRoles = errors.New("invalid role definitions")
+	// ErrRolesAssigned indicates that roles can't be redefined while agents
+	// hold them.
+	ErrRolesAssigned = errors.New("roles are already assigned to agents")
+	// ErrUnknownRole indicates that role is not defined for test.
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrRoleFull indicates that all slots of role are taken.
+	ErrRoleFull = errors.New("no free role slots")
+	// ErrRoleConflict indicates that agent already holds another role.
+	ErrRoleConflict = errors.New("agent already holds another role")
+)
+
+// RoleCount limits number of agents in role, 0 means unlimited and is
+// encoded as "*".
+type RoleCount int
+
+// MarshalJSON implements json.Marshaler.
+func (c RoleCount) MarshalJSON() ([]byte, error) {
+	if c == 0 {
+		return json.Marshal(RoleAny)
+	}
+
+	return json.Marshal(int(c))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *RoleCount) UnmarshalJSON(data []byte) error {
+	if string(data) == `"`+RoleAny+`"` {
+		*c = 0
+		return nil
+	}
+
+	var count int
+	if err := json.Unmarshal(data, &count); err != nil || count < 1 {
+		return fmt.Errorf(
+			"%w: role count must be a positive integer or %q", ErrInvalidRoles, RoleAny,
+		)
+	}
+
+	*c = RoleCount(count)
+
+	return nil
+}
+
+// RoleDefinition describes a role and how many agents may hold it.
+type RoleDefinition struct {
+	Name  string    `json:"name"`
+	Count RoleCount `json:"count"`
+}
+
+// RoleAssignment describes role slot held by an agent. Ordinals start from 0
+// and are unique within role.
+type RoleAssignment struct {
+	Role    string `json:"role"`
+	Ordinal int    `json:"ordinal"`
+}
+
+// ParseRoleDefinitions parses JSON object of role names and counts, e.g.
+// {"presenter":1,"viewer":"*"}, keeping order of roles.
+func ParseRoleDefinitions(data []byte) ([]RoleDefinition, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("%w: expected JSON object", ErrInvalidRoles)
+	}
+
+	var defs []RoleDefinition
+	seen := make(map[string]bool)
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidRoles, err.Error())
+		}
+
+		name, _ := tok.(string) // nolint: errcheck
+		if ValidateName(name) != nil || seen[name] {
+			return nil, fmt.Errorf("%w: invalid role name %q", ErrInvalidRoles, name)
+		}
+		seen[name] = true
+
+		var count RoleCount
+		if err := dec.Decode(&count); err != nil {
+			return nil, err
+		}
+
+		defs = append(defs, RoleDefinition{Name: name, Count: count})
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRoles, err.Error())
+	}
+
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("%w: no roles defined", ErrInvalidRoles)
+	}
+
+	return defs, nil
+}
+
+// SetRoles defines roles of test. Roles can't be redefined once assigned.
+func (t *Test) SetRoles(defs []RoleDefinition) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.roleAssignments) > 0 {
+		return ErrRolesAssigned
+	}
+
+	t.roles = defs
+
+	return nil
+}
+
+// GetRoles returns role definitions and assignments by agent ID.
+func (t *Test) GetRoles() ([]RoleDefinition, map[string]RoleAssignment) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	defs := make([]RoleDefinition, len(t.roles))
+	copy(defs, t.roles)
+
+	assignments := make(map[string]RoleAssignment, len(t.roleAssignments))
+	for agentID, assignment := range t.roleAssignments {
+		assignments[agentID] = assignment
+	}
+
+	return defs, assignments
+}
+
+// ClaimRole assigns agent a free slot of role. Empty role takes the first
+// role with a free slot in order of definition. Claiming a role that agent
+// already holds returns its current slot.
+func (t *Test) ClaimRole(agentID, role string) (RoleAssignment, error) {
+	return t.claimRole(agentID, role, true)
+}
+
+// ClaimNewRole assigns agent a free slot of role like ClaimRole, but fails
+// with ErrRoleConflict if agent already holds a role, so a successful caller
+// is the only owner of the slot.
+func (t *Test) ClaimNewRole(agentID, role string) (RoleAssignment, error) {
+	return t.claimRole(agentID, role, false)
+}
+
+func (t *Test) claimRole(
+	agentID, role string, reclaim bool,
+) (RoleAssignment, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, ok := t.roleAssignments[agentID]; ok {
+		if reclaim && (role == "" || role == current.Role) {
+			return current, nil
+		}
+
+		return RoleAssignment{}, ErrRoleConflict
+	}
+
+	for _, def := range t.roles {
+		if role != "" && def.Name != role {
+			continue
+		}
+
+		ordinal, ok := t.freeOrdinal(def)
+		if !ok {
+			if role == "" {
+				continue
+			}
+
+			return RoleAssignment{}, ErrRoleFull
+		}
+
+		if t.roleAssignments == nil {
+			t.roleAssignments = make(map[string]RoleAssignment)
+		}
+
+		assignment := RoleAssignment{Role: def.Name, Ordinal: ordinal}
+		t.roleAssignments[agentID] = assignment
+
+		return assignment, nil
+	}
+
+	if role == "" && len(t.roles) > 0 {
+		return RoleAssignment{}, ErrRoleFull
+	}
+
+	return RoleAssignment{}, ErrUnknownRole
+}
+
+// AgentRole returns role slot held by agent.
+func (t *Test) AgentRole(agentID string) (RoleAssignment, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	assignment, ok := t.roleAssignments[agentID]
+	return assignment, ok
+}
+
+// RoleMembers returns IDs of agents holding role, ordered by ordinal.
+func (t *Test) RoleMembers(role string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var members []RoleAssignment
+	ids := make(map[RoleAssignment]string)
+	for agentID, assignment := range t.roleAssignments {
+		if assignment.Role == role {
+			members = append(members, assignment)
+			ids[assignment] = agentID
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Ordinal < members[j].Ordinal
+	})
+
+	agentIDs := make([]string, len(members))
+	for i, member := range members {
+		agentIDs[i] = ids[member]
+	}
+
+	return agentIDs
+}
+
+// ReleaseRole frees role slot held by agent.
+func (t *Test) ReleaseRole(agentID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.roleAssignments, agentID)
+}
+
+// freeOrdinal returns the lowest free ordinal of role. Must be called with
+// t.mu held.
+func (t *Test) freeOrdinal(def RoleDefinition) (int, bool) {
+	taken := make(map[int]bool)
+	for _, assignment := range t.roleAssignments {
+		if assignment.Role == def.Name {
+			taken[assignment.Ordinal] = true
+		}
+	}
+
+	for ordinal := 0; ; ordinal++ {
+		if def.Count > 0 && ordinal >= int(def.Count) {
+			return 0, false
+		}
+
+		if !taken[ordinal] {
+			return ordinal, true
+		}
+	}
+}
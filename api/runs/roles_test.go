@@ -0,0 +1,90 @@
+package runs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRoleDefinitions(t *testing.T) {
+	defs, err := ParseRoleDefinitions([]byte(`{"presenter":1,"viewer":"*","host":2}`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := []RoleDefinition{
+		{Name: "presenter", Count: 1},
+		{Name: "viewer", Count: 0},
+		{Name: "host", Count: 2},
+	}
+	if len(defs) != len(expected) {
+		t.Fatalf("unexpected definitions: %+v", defs)
+	}
+	for i := range expected {
+		if defs[i] != expected[i] {
+			t.Fatalf("unexpected definition %d: %+v", i, defs[i])
+		}
+	}
+
+	invalid := []string{
+		``, `[]`, `{}`, `{"a":0}`, `{"a":"many"}`, `{"a":1,"a":2}`, `{"a b":1}`, `{"a":1`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseRoleDefinitions([]byte(data)); err == nil {
+			t.Fatalf("expected error for %q", data)
+		}
+	}
+}
+
+func TestClaimRole(t *testing.T) {
+	test := &Test{}
+
+	if _, err := test.ClaimRole("a", "presenter"); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("expected ErrUnknownRole, got %v", err)
+	}
+
+	if err := test.SetRoles([]RoleDefinition{
+		{Name: "presenter", Count: 1},
+		{Name: "viewer", Count: 0},
+	}); err != nil {
+		t.Fatalf("set roles failed: %v", err)
+	}
+
+	claim := func(agentID, role string, expected RoleAssignment) {
+		t.Helper()
+
+		assignment, err := test.ClaimRole(agentID, role)
+		if err != nil || assignment != expected {
+			t.Fatalf("unexpected claim of %q by %q: %+v, %v", role, agentID, assignment, err)
+		}
+	}
+
+	claim("a", "", RoleAssignment{Role: "presenter", Ordinal: 0})
+	claim("a", "presenter", RoleAssignment{Role: "presenter", Ordinal: 0})
+	claim("b", "", RoleAssignment{Role: "viewer", Ordinal: 0})
+	claim("c", "viewer", RoleAssignment{Role: "viewer", Ordinal: 1})
+
+	if _, err := test.ClaimRole("d", "presenter"); !errors.Is(err, ErrRoleFull) {
+		t.Fatalf("expected ErrRoleFull, got %v", err)
+	}
+
+	if _, err := test.ClaimRole("a", "viewer"); !errors.Is(err, ErrRoleConflict) {
+		t.Fatalf("expected ErrRoleConflict, got %v", err)
+	}
+
+	if _, err := test.ClaimNewRole("a", "presenter"); !errors.Is(err, ErrRoleConflict) {
+		t.Fatalf("expected ErrRoleConflict on new claim, got %v", err)
+	}
+
+	if err := test.SetRoles(nil); !errors.Is(err, ErrRolesAssigned) {
+		t.Fatalf("expected ErrRolesAssigned, got %v", err)
+	}
+
+	// released slot is reused.
+	test.ReleaseRole("b")
+	claim("d", "viewer", RoleAssignment{Role: "viewer", Ordinal: 0})
+
+	members := test.RoleMembers("viewer")
+	if len(members) != 2 || members[0] != "d" || members[1] != "c" {
+		t.Fatalf("unexpected viewers: %v", members)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
@@ -13,7 +12,6 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 	"github.com/paulsgrudups/testsync/api/auth"
 	"github.com/paulsgrudups/testsync/utils"
 	"github.com/pkg/errors"
@@ -22,27 +20,51 @@ import (
 var (
 	// SyncClient defines sync client credentials.
 	SyncClient utils.BasicCredentials
+
+	// ErrInvalidTestID indicates that provided test ID is not valid.
+	ErrInvalidTestID = stderrors.New("invalid test ID")
+	// ErrInvalidName indicates that name of a coordination primitive (counter,
+	// lock, etc.) is not valid.
+	ErrInvalidName = stderrors.New("invalid name")
 )
 
 const (
 	cleanupInterval = 12 * time.Hour
 	cleanupAge      = 12 * time.Hour
 	maxBodyBytes    = 10 << 20
+	maxTestIDLength = 128
 )
 
 // Test describes a single test instance with it's saved data and connections.
 type Test struct {
+	// id is set once test is stored in AllTests.
+	id          string
 	Created     time.Time
 	Data        []byte
-	Connections []*websocket.Conn
+	Connections map[string]*Agent
 	CheckPoints map[string]*Checkpoint
+	Locks       map[string]*Lock
+	Semaphores  map[string]*Semaphore
+	Elections   map[string]*Election
+	Queues      map[string]*Queue
+	Channels    map[string]*Channel
 	ForceEnd    bool
-	mu          sync.RWMutex
+	// watchers hold request IDs of data watches by key and agent ID.
+	watchers        map[string]map[string]string
+	roles           []RoleDefinition
+	roleAssignments map[string]RoleAssignment
+	feeds           map[string]*Feed
+	// service persists test state, e.g. pool leases.
+	service *Service
+	// checkpointStarts hold start times of checkpoints that are not created
+	// yet by identifier.
+	checkpointStarts map[string]time.Time
+	mu               sync.RWMutex
 }
 
 // RegisterTestsRoutes registers all tests routes.
 func RegisterTestsRoutes(r *mux.Router) {
-	subrouter := r.PathPrefix(`/tests/{testID:\d+}`).
+	subrouter := r.PathPrefix(`/tests/{testID}`).
 		Subrouter().StrictSlash(false)
 
 	subrouter.Use(auth.BasicAuthMiddleware(auth.NewValidator(SyncClient)))
@@ -53,6 +75,21 @@ func RegisterTestsRoutes(r *mux.Router) {
 	subrouter.HandleFunc(``, createHandler).Methods(http.MethodPost)
 	subrouter.HandleFunc(`/`, readHandler).Methods(http.MethodGet)
 	subrouter.HandleFunc(``, readHandler).Methods(http.MethodGet)
+	subrouter.HandleFunc(`/`, replaceHandler).Methods(http.MethodPut)
+	subrouter.HandleFunc(``, replaceHandler).Methods(http.MethodPut)
+	subrouter.HandleFunc(`/`, patchHandler).Methods(http.MethodPatch)
+	subrouter.HandleFunc(``, patchHandler).Methods(http.MethodPatch)
+	subrouter.HandleFunc(`/`, deleteHandler).Methods(http.MethodDelete)
+	subrouter.HandleFunc(``, deleteHandler).Methods(http.MethodDelete)
+
+	registerKeyRoutes(subrouter)
+	registerCounterRoutes(subrouter)
+	registerRoleRoutes(subrouter)
+	registerPoolRoutes(subrouter, `/pools`)
+	registerFeedRoutes(subrouter)
+	registerQueueRoutes(subrouter)
+	registerBroadcastRoutes(subrouter)
+	registerCheckpointRoutes(subrouter)
 }
 
 func createHandler(w http.ResponseWriter, r *http.Request) {
@@ -70,7 +107,8 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := DefaultService.CreateTestData(testID, body); err != nil {
+	version, err := DefaultService.CreateTestData(testID, body)
+	if err != nil {
 		if stderrors.Is(err, ErrTestExists) {
 			utils.HTTPError(
 				w, "Provided test already has set data", http.StatusConflict,
@@ -85,6 +123,7 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("Set data for test")
 
+	w.Header().Set("ETag", formatETag(version))
 	writeResponse(w, body, http.StatusOK)
 }
 
@@ -96,7 +135,7 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger := log.WithField("test_id", testID)
 
-	data, err := DefaultService.ReadTestData(testID)
+	data, version, err := DefaultService.ReadTestDataVersion(testID)
 	if err != nil {
 		if stderrors.Is(err, ErrTestNotFound) {
 			logger.Debug("Data not found")
@@ -109,11 +148,155 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", formatETag(version))
+
+	if !noneMatch(r, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	logger.Info("Reading data for test")
 
 	writeResponse(w, data, http.StatusOK)
 }
 
+func replaceHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	logger := log.WithField("test_id", testID)
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	expected, ok := getExpectedVersion(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := DefaultService.UpdateTestDataIfVersion(testID, body, expected)
+	if err != nil {
+		if stderrors.Is(err, ErrVersionMismatch) {
+			utils.HTTPError(
+				w, "Test data version does not match", http.StatusPreconditionFailed,
+			)
+			return
+		}
+
+		logger.Errorf("Could not store data: %s", err.Error())
+		utils.HTTPError(w, "Could not store data", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Replaced data for test")
+
+	w.Header().Set("ETag", formatETag(version))
+	writeResponse(w, body, http.StatusOK)
+}
+
+func patchHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	logger := log.WithField("test_id", testID)
+
+	body, err := readBodyData(w, r.Body)
+	if err != nil {
+		logger.Errorf("Could not read body data: %s", err.Error())
+		return
+	}
+
+	expected, ok := getExpectedVersion(w, r)
+	if !ok {
+		return
+	}
+
+	data, version, err := DefaultService.PatchTestData(testID, body, expected)
+	if err != nil {
+		switch {
+		case stderrors.Is(err, ErrVersionMismatch):
+			utils.HTTPError(
+				w, "Test data version does not match", http.StatusPreconditionFailed,
+			)
+		case stderrors.Is(err, ErrTestNotFound):
+			utils.HTTPError(w, "Could not find test", http.StatusNotFound)
+		case stderrors.Is(err, ErrInvalidPatch):
+			utils.HTTPError(
+				w, "Merge patch is not a valid JSON document", http.StatusBadRequest,
+			)
+		case stderrors.Is(err, ErrDataNotJSON):
+			utils.HTTPError(
+				w, "Stored test data is not a JSON document", http.StatusConflict,
+			)
+		default:
+			logger.Errorf("Could not patch data: %s", err.Error())
+			utils.HTTPError(
+				w, "Could not patch data", http.StatusInternalServerError,
+			)
+		}
+
+		return
+	}
+
+	logger.Info("Patched data for test")
+
+	w.Header().Set("ETag", formatETag(version))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeResponse(w, data, http.StatusOK)
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	testID, err := GetPathID(w, r, "testID")
+	if err != nil {
+		return
+	}
+
+	logger := log.WithField("test_id", testID)
+
+	if err := DefaultService.DeleteTest(testID); err != nil {
+		if stderrors.Is(err, ErrTestNotFound) {
+			utils.HTTPError(w, "Could not find test", http.StatusNotFound)
+			return
+		}
+
+		logger.Errorf("Could not delete test: %s", err.Error())
+		utils.HTTPError(w, "Could not delete test", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Deleted test")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getExpectedVersion returns version required by conditional request headers.
+// In case of invalid headers, error response is written.
+func getExpectedVersion(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	expected, err := expectedVersion(r)
+	if stderrors.Is(err, ErrVersionMismatch) {
+		utils.HTTPError(
+			w, "Weak entity tags do not match If-Match", http.StatusPreconditionFailed,
+		)
+
+		return 0, false
+	}
+	if err != nil {
+		log.Debugf("Invalid precondition: %s", err.Error())
+		utils.HTTPError(w, err.Error(), http.StatusBadRequest)
+
+		return 0, false
+	}
+
+	return expected, true
+}
+
 func readBodyData(w http.ResponseWriter, body io.ReadCloser) ([]byte, error) {
 	if body == nil {
 		return nil, nil
@@ -134,26 +317,45 @@ func readBodyData(w http.ResponseWriter, body io.ReadCloser) ([]byte, error) {
 	return bodyContent, nil
 }
 
-// GetPathID ...
+// ValidateTestID checks that test ID is a non-empty string of up to 128
+// characters from A-Z, a-z, 0-9, ".", "_" and "-".
+func ValidateTestID(id string) error {
+	if len(id) == 0 || len(id) > maxTestIDLength || !identifierPattern.MatchString(id) {
+		return ErrInvalidTestID
+	}
+
+	return nil
+}
+
+// ValidateName checks that name of a coordination primitive follows the same
+// rules as test IDs.
+func ValidateName(name string) error {
+	if ValidateTestID(name) != nil {
+		return ErrInvalidName
+	}
+
+	return nil
+}
+
+// GetPathID returns validated test ID from path variable. In case of an
+// invalid ID, error response is written.
 func GetPathID(
 	w http.ResponseWriter, r *http.Request, field string,
-) (int, error) {
-	id, err := strconv.Atoi(mux.Vars(r)[field])
-	if err != nil {
-		log.Debugf(
-			"Unable to parse %s as int: invalid integer %q",
-			field, mux.Vars(r)[field],
-		)
+) (string, error) {
+	id := mux.Vars(r)[field]
+
+	if err := ValidateTestID(id); err != nil {
+		log.Debugf("Invalid %s %q", field, id)
 		utils.HTTPError(
 			w,
 			fmt.Sprintf(
-				"Unable to parse %s as int: invalid integer %q",
-				field, mux.Vars(r)[field],
+				"Invalid %s %q: expected up to %d characters of A-Z a-z 0-9 . _ -",
+				field, id, maxTestIDLength,
 			),
 			http.StatusBadRequest,
 		)
 
-		return 0, errors.Wrap(err, "could not parse integer value")
+		return "", err
 	}
 
 	return id, nil
@@ -171,12 +373,7 @@ func startCleanupTicker() {
 		for range ticker.C {
 			deleteLimit := time.Now().Add(-cleanupAge)
 
-			RangeTests(func(testID int, t *Test) {
-				if t.Created.Before(deleteLimit) {
-					log.WithField("test_id", testID).Info("Deleting expired test")
-					DeleteTest(testID)
-				}
-			})
+			deleteExpiredTests(deleteLimit)
 
 			if err := DeleteDataOlderThan(deleteLimit); err != nil {
 				log.Errorf("Failed to delete old data: %s", err.Error())
@@ -184,3 +381,20 @@ func startCleanupTicker() {
 		}
 	}()
 }
+
+// deleteExpiredTests deletes tests created before limit the same way as HTTP
+// delete does, closing their connections and checkpoints.
+func deleteExpiredTests(limit time.Time) {
+	RangeTests(func(testID string, t *Test) {
+		if !t.Created.Before(limit) {
+			return
+		}
+
+		logger := log.WithField("test_id", testID)
+		logger.Info("Deleting expired test")
+
+		if err := DefaultService.DeleteTest(testID); err != nil {
+			logger.Errorf("Failed to delete expired test: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package runs
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageSemaphoreGranted is pushed to agent once it obtains a permit.
+const MessageSemaphoreGranted = "sem_granted"
+
+var (
+	// ErrSemaphoreConflict indicates that agent already holds or waits for a
+	// permit.
+	ErrSemaphoreConflict = errors.New("agent already holds or waits for permit")
+	// ErrSemaphoreNotHeld indicates that agent neither holds nor waits for a
+	// permit.
+	ErrSemaphoreNotHeld = errors.New("permit is not held by agent")
+	// ErrSemaphorePermits indicates that semaphore exists with a different
+	// permit count.
+	ErrSemaphorePermits = errors.New("semaphore exists with different permit count")
+)
+
+// SemaphoreRequest describes an agent holding or waiting for a permit.
+type SemaphoreRequest struct {
+	Waiter
+}
+
+// Semaphore describes a named counting semaphore shared by agents of a test.
+// Each agent may hold a single permit, waiters obtain permits in FIFO order.
+type Semaphore struct {
+	Name    string
+	Permits int
+	holders map[string]SemaphoreRequest
+	waiters []SemaphoreRequest
+	t       *Test
+	mu      sync.Mutex
+}
+
+// NewSemaphore creates a semaphore with provided permit count for test.
+func NewSemaphore(name string, permits int, t *Test) *Semaphore {
+	return &Semaphore{
+		Name:    name,
+		Permits: permits,
+		holders: make(map[string]SemaphoreRequest),
+		t:       t,
+	}
+}
+
+// Acquire grants a permit to agent if one is available, otherwise agent is
+// queued. Agent receives sem_granted message once it holds a permit.
+func (s *Semaphore) Acquire(req SemaphoreRequest) error {
+	s.mu.Lock()
+
+	if _, ok := s.holders[req.AgentID]; ok || s.waiting(req.AgentID) >= 0 {
+		s.mu.Unlock()
+		return ErrSemaphoreConflict
+	}
+
+	if len(s.holders) >= s.Permits {
+		s.waiters = append(s.waiters, req)
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	s.holders[req.AgentID] = req
+	s.mu.Unlock()
+
+	s.notify(req)
+
+	return nil
+}
+
+// Release returns permit held by agent and grants it to the next waiter. If
+// agent is only waiting for a permit, it leaves the queue.
+func (s *Semaphore) Release(agentID string) error {
+	s.mu.Lock()
+
+	if i := s.waiting(agentID); i >= 0 {
+		s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	if _, ok := s.holders[agentID]; !ok {
+		s.mu.Unlock()
+		return ErrSemaphoreNotHeld
+	}
+
+	delete(s.holders, agentID)
+
+	var granted []SemaphoreRequest
+	for len(s.waiters) > 0 && len(s.holders) < s.Permits {
+		waiter := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.holders[waiter.AgentID] = waiter
+
+		granted = append(granted, waiter)
+	}
+	s.mu.Unlock()
+
+	for _, req := range granted {
+		s.notify(req)
+	}
+
+	return nil
+}
+
+// Holders returns the number of held permits.
+func (s *Semaphore) Holders() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.holders)
+}
+
+// Waiters returns the number of agents waiting for a permit.
+func (s *Semaphore) Waiters() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.waiters)
+}
+
+// waiting returns position of agent in waiting queue, -1 if it's not
+// waiting. Must be called with s.mu held.
+func (s *Semaphore) waiting(agentID string) int {
+	for i, waiter := range s.waiters {
+		if waiter.AgentID == agentID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *Semaphore) notify(req SemaphoreRequest) {
+	agent := s.t.GetConnection(req.AgentID)
+	if agent == nil {
+		return
+	}
+
+	err := agent.Reply(req.RequestID, MessageSemaphoreGranted, struct {
+		Name string `json:"name"`
+	}{Name: s.Name})
+	if err != nil {
+		log.Errorf("Could not notify agent %q about semaphore %q: %s",
+			req.AgentID, s.Name, err.Error())
+	}
+}
+
+// EnsureSemaphore gets or creates a named semaphore. Returns
+// ErrSemaphorePermits if semaphore exists with a different permit count.
+func (t *Test) EnsureSemaphore(name string, permits int) (*Semaphore, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.Semaphores[name]; ok {
+		if s.Permits != permits {
+			return nil, ErrSemaphorePermits
+		}
+
+		return s, nil
+	}
+
+	if t.Semaphores == nil {
+		t.Semaphores = make(map[string]*Semaphore)
+	}
+
+	s := NewSemaphore(name, permits, t)
+	t.Semaphores[name] = s
+
+	return s, nil
+}
+
+// GetSemaphore returns a semaphore by name.
+func (t *Test) GetSemaphore(name string) (*Semaphore, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.Semaphores[name]
+	return s, ok
+}
+
+// releaseSemaphores returns permits held by agent and removes it from
+// waiters.
+func (t *Test) releaseSemaphores(agentID string) {
+	t.mu.RLock()
+	semaphores := make([]*Semaphore, 0, len(t.Semaphores))
+	for _, s := range t.Semaphores {
+		semaphores = append(semaphores, s)
+	}
+	t.mu.RUnlock()
+
+	for _, s := range semaphores {
+		s.Release(agentID) // nolint: errcheck, gosec
+	}
+}
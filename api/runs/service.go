@@ -12,6 +12,23 @@ var (
 	ErrTestExists = errors.New("test data already exists")
 	// ErrTestNotFound indicates test data not found.
 	ErrTestNotFound = errors.New("test data not found")
+	// ErrInvalidPatch indicates that merge patch is not a valid JSON document.
+	ErrInvalidPatch = errors.New("invalid merge patch")
+	// ErrDataNotJSON indicates that stored test data is not a JSON document
+	// and can't be patched.
+	ErrDataNotJSON = errors.New("test data is not a JSON document")
+	// ErrVersionMismatch indicates that test data version differs from the
+	// expected one.
+	ErrVersionMismatch = storage.ErrVersionMismatch
+)
+
+const (
+	// AnyVersion disables version check on writes.
+	AnyVersion = storage.AnyVersion
+	// ExistingVersion requires test data to exist regardless of its version.
+	ExistingVersion int64 = -2
+
+	maxPatchAttempts = 10
 )
 
 // Service provides higher level operations for test data.
@@ -36,72 +53,173 @@ func (s *Service) store() storage.DataStore {
 	return s.storeProvider()
 }
 
-// CreateTestData stores test data if it does not already exist.
-func (s *Service) CreateTestData(testID int, data []byte) error {
-	if _, ok := GetTest(testID); ok {
-		return ErrTestExists
+// CreateTestData stores test data if it does not already exist and returns
+// its version. Test created in memory by other primitives, e.g. connections,
+// has no data yet and can be created.
+func (s *Service) CreateTestData(testID string, data []byte) (int64, error) {
+	if t, ok := GetTest(testID); ok && len(t.GetData()) > 0 {
+		return 0, ErrTestExists
 	}
 
-	if _, ok, err := s.store().LoadData(testID); err != nil {
-		return err
-	} else if ok {
-		return ErrTestExists
-	}
+	version, err := s.store().CompareAndSave(testID, data, 0)
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) {
+			return 0, ErrTestExists
+		}
 
-	if err := s.store().SaveData(testID, data); err != nil {
-		return err
+		return 0, err
 	}
 
-	if t, ok := GetTest(testID); ok {
-		t.SetData(data)
-	} else {
-		SetTest(testID, &Test{
-			Created:     nowUTC(),
-			Data:        data,
-			CheckPoints: make(map[string]*Checkpoint),
-		})
-	}
+	s.EnsureTest(testID).SetData(data)
+	notifyDataChanged(testID, DefaultKey, data, version)
 
-	return nil
+	return version, nil
 }
 
-// UpdateTestData stores test data regardless of existing state.
-func (s *Service) UpdateTestData(testID int, data []byte) error {
-	if err := s.store().SaveData(testID, data); err != nil {
-		return err
+// UpdateTestData stores test data regardless of existing state and returns
+// its new version.
+func (s *Service) UpdateTestData(testID string, data []byte) (int64, error) {
+	return s.UpdateTestDataIfVersion(testID, data, AnyVersion)
+}
+
+// UpdateTestDataIfVersion stores test data if its current version matches
+// expected one, otherwise ErrVersionMismatch is returned. Agents watching test
+// data are notified about the change. Expected version 0
+// requires data to not exist, ExistingVersion requires data to exist and
+// AnyVersion skips the check.
+func (s *Service) UpdateTestDataIfVersion(
+	testID string, data []byte, expected int64,
+) (int64, error) {
+	if expected == ExistingVersion {
+		_, current, ok, err := s.store().LoadDataVersion(testID)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrVersionMismatch
+		}
+
+		expected = current
 	}
 
-	if t, ok := GetTest(testID); ok {
-		t.SetData(data)
-	} else {
-		SetTest(testID, &Test{
-			Created:     nowUTC(),
-			Data:        data,
-			CheckPoints: make(map[string]*Checkpoint),
-		})
+	version, err := s.store().CompareAndSave(testID, data, expected)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	s.EnsureTest(testID).SetData(data)
+	notifyDataChanged(testID, DefaultKey, data, version)
+
+	return version, nil
 }
 
 // ReadTestData returns test data or ErrTestNotFound.
-func (s *Service) ReadTestData(testID int) ([]byte, error) {
-	data, ok, err := s.store().LoadData(testID)
+func (s *Service) ReadTestData(testID string) ([]byte, error) {
+	data, _, err := s.ReadTestDataVersion(testID)
+	return data, err
+}
+
+// ReadTestDataVersion returns test data with its version or ErrTestNotFound.
+// Data that is only kept in memory has version 0.
+func (s *Service) ReadTestDataVersion(testID string) ([]byte, int64, error) {
+	data, version, ok, err := s.store().LoadDataVersion(testID)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if ok {
-		return data, nil
+		return data, version, nil
 	}
 
 	if m, exists := GetTest(testID); exists {
 		data = m.GetData()
 		if len(data) > 0 {
-			return data, nil
+			return data, 0, nil
+		}
+	}
+
+	return nil, 0, ErrTestNotFound
+}
+
+// PatchTestData applies JSON Merge Patch (RFC 7396) to test data and returns
+// the patched document with its version. Patch is applied only if data
+// version matches expected one, see UpdateTestDataIfVersion. With AnyVersion
+// and ExistingVersion patch is retried when data changes concurrently.
+func (s *Service) PatchTestData(
+	testID string, patch []byte, expected int64,
+) ([]byte, int64, error) {
+	for attempt := 0; ; attempt++ {
+		data, current, err := s.ReadTestDataVersion(testID)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if expected != AnyVersion && expected != ExistingVersion &&
+			expected != current {
+			return nil, 0, ErrVersionMismatch
+		}
+
+		patched, err := applyMergePatch(data, patch)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		version, err := s.UpdateTestDataIfVersion(testID, patched, current)
+		retry := expected == AnyVersion || expected == ExistingVersion
+		if errors.Is(err, ErrVersionMismatch) && retry &&
+			attempt < maxPatchAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
 		}
+
+		return patched, version, nil
 	}
+}
+
+// DeleteTest removes test data with all of its keys, counters and pools,
+// closes test connections and drops its checkpoints. Returns ErrTestNotFound
+// if test is neither stored nor kept in memory.
+func (s *Service) DeleteTest(testID string) error {
+	stored, err := s.store().TestExists(testID)
+	if err != nil {
+		return err
+	}
+
+	t, exists := GetTest(testID)
+	if !stored && !exists {
+		return ErrTestNotFound
+	}
+
+	if err := s.store().DeleteData(testID); err != nil {
+		return err
+	}
+
+	if exists {
+		DeleteTest(testID)
+		t.Close()
+	}
+
+	return nil
+}
+
+// EnsureTest returns in-memory test, creating it if needed. Created test
+// uses the service to persist its state, e.g. to return pool leases of
+// removed agents.
+func (s *Service) EnsureTest(testID string) *Test {
+	return EnsureTest(testID, func() *Test {
+		return &Test{
+			Created:     nowUTC(),
+			Connections: make(map[string]*Agent),
+			CheckPoints: make(map[string]*Checkpoint),
+			service:     s,
+		}
+	})
+}
 
-	return nil, ErrTestNotFound
+// ensureTest returns in-memory test of DefaultService, creating it if needed.
+func ensureTest(testID string) *Test {
+	return DefaultService.EnsureTest(testID)
 }
 
 func nowUTC() time.Time {
@@ -7,14 +7,14 @@ import (
 )
 
 func TestService_CreateAndRead(t *testing.T) {
-	AllTests = make(map[int]*Test)
+	AllTests = make(map[string]*Test)
 
 	service := NewService(storage.NewMemoryStore())
-	if err := service.CreateTestData(10, []byte("payload")); err != nil {
+	if _, err := service.CreateTestData("10", []byte("payload")); err != nil {
 		t.Fatalf("create failed: %v", err)
 	}
 
-	data, err := service.ReadTestData(10)
+	data, err := service.ReadTestData("10")
 	if err != nil {
 		t.Fatalf("read failed: %v", err)
 	}
@@ -24,14 +24,117 @@ func TestService_CreateAndRead(t *testing.T) {
 }
 
 func TestService_CreateDuplicate(t *testing.T) {
-	AllTests = make(map[int]*Test)
+	AllTests = make(map[string]*Test)
 
 	service := NewService(storage.NewMemoryStore())
-	if err := service.CreateTestData(10, []byte("payload")); err != nil {
+	if _, err := service.CreateTestData("10", []byte("payload")); err != nil {
 		t.Fatalf("create failed: %v", err)
 	}
 
-	if err := service.CreateTestData(10, []byte("payload")); err != ErrTestExists {
+	if _, err := service.CreateTestData("10", []byte("payload")); err != ErrTestExists {
 		t.Fatalf("expected ErrTestExists, got %v", err)
 	}
 }
+
+func TestService_UpdateIfVersion(t *testing.T) {
+	AllTests = make(map[string]*Test)
+
+	service := NewService(storage.NewMemoryStore())
+	version, err := service.CreateTestData("10", []byte(`{"a":1}`))
+	if err != nil || version != 1 {
+		t.Fatalf("create failed: version %d, err %v", version, err)
+	}
+
+	version, err = service.UpdateTestDataIfVersion("10", []byte(`{"a":2}`), 1)
+	if err != nil || version != 2 {
+		t.Fatalf("update failed: version %d, err %v", version, err)
+	}
+
+	_, err = service.UpdateTestDataIfVersion("10", []byte(`{"a":3}`), 1)
+	if err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+
+	_, err = service.UpdateTestDataIfVersion("11", []byte(`{}`), ExistingVersion)
+	if err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch for missing data, got %v", err)
+	}
+
+	data, version, err := service.PatchTestData("10", []byte(`{"b":true}`), 2)
+	if err != nil || version != 3 {
+		t.Fatalf("patch failed: version %d, err %v", version, err)
+	}
+	if string(data) != `{"a":2,"b":true}` {
+		t.Fatalf("unexpected data: %s", data)
+	}
+
+	if _, _, err := service.PatchTestData("10", []byte(`{}`), 2); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch on patch, got %v", err)
+	}
+}
+
+// racingStore writes test data right before the first compare-and-save,
+// simulating a concurrent write.
+type racingStore struct {
+	storage.DataStore
+	raced bool
+}
+
+func (s *racingStore) CompareAndSave(
+	testID string, data []byte, expected int64,
+) (int64, error) {
+	if !s.raced {
+		s.raced = true
+
+		_, err := s.DataStore.CompareAndSave(testID, []byte(`{"a":3}`), AnyVersion)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return s.DataStore.CompareAndSave(testID, data, expected)
+}
+
+func TestService_PatchExistingRetries(t *testing.T) {
+	AllTests = make(map[string]*Test)
+
+	store := storage.NewMemoryStore()
+	if _, err := store.CompareAndSave("10", []byte(`{"a":1}`), 0); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	service := NewService(&racingStore{DataStore: store})
+	data, version, err := service.PatchTestData(
+		"10", []byte(`{"b":true}`), ExistingVersion,
+	)
+	if err != nil || version != 3 {
+		t.Fatalf("patch failed: version %d, err %v", version, err)
+	}
+	if string(data) != `{"a":3,"b":true}` {
+		t.Fatalf("unexpected data: %s", data)
+	}
+}
+
+func TestService_DeletePersistedTest(t *testing.T) {
+	AllTests = make(map[string]*Test)
+
+	store := storage.NewMemoryStore()
+	if _, err := store.AddCounter("10", "users", 1); err != nil {
+		t.Fatalf("add counter failed: %v", err)
+	}
+	if err := store.SavePool("11", "accounts", [][]byte{[]byte(`1`)}); err != nil {
+		t.Fatalf("save pool failed: %v", err)
+	}
+
+	// tests are only stored, e.g. after a restart.
+	service := NewService(store)
+	for _, testID := range []string{"10", "11"} {
+		if err := service.DeleteTest(testID); err != nil {
+			t.Fatalf("delete of %q failed: %v", testID, err)
+		}
+
+		if err := service.DeleteTest(testID); err != ErrTestNotFound {
+			t.Fatalf("expected ErrTestNotFound for %q, got %v", testID, err)
+		}
+	}
+}
@@ -4,12 +4,12 @@ import "sync"
 
 // AllTests holds all registered tests (compatibility). Use helpers for access.
 var (
-	AllTests   = make(map[int]*Test)
+	AllTests   = make(map[string]*Test)
 	allTestsMu sync.RWMutex
 )
 
 // GetTest returns a test by ID.
-func GetTest(id int) (*Test, bool) {
+func GetTest(id string) (*Test, bool) {
 	allTestsMu.RLock()
 	defer allTestsMu.RUnlock()
 
@@ -18,15 +18,16 @@ func GetTest(id int) (*Test, bool) {
 }
 
 // SetTest sets a test by ID.
-func SetTest(id int, t *Test) {
+func SetTest(id string, t *Test) {
 	allTestsMu.Lock()
 	defer allTestsMu.Unlock()
 
+	t.id = id
 	AllTests[id] = t
 }
 
 // DeleteTest removes a test by ID.
-func DeleteTest(id int) {
+func DeleteTest(id string) {
 	allTestsMu.Lock()
 	defer allTestsMu.Unlock()
 
@@ -34,7 +35,7 @@ func DeleteTest(id int) {
 }
 
 // EnsureTest gets or creates a test by ID.
-func EnsureTest(id int, create func() *Test) *Test {
+func EnsureTest(id string, create func() *Test) *Test {
 	allTestsMu.Lock()
 	defer allTestsMu.Unlock()
 
@@ -43,15 +44,16 @@ func EnsureTest(id int, create func() *Test) *Test {
 	}
 
 	created := create()
+	created.id = id
 	AllTests[id] = created
 
 	return created
 }
 
 // RangeTests iterates over a snapshot of tests.
-func RangeTests(fn func(id int, t *Test)) {
+func RangeTests(fn func(id string, t *Test)) {
 	allTestsMu.RLock()
-	snapshot := make(map[int]*Test, len(AllTests))
+	snapshot := make(map[string]*Test, len(AllTests))
 	for id, t := range AllTests {
 		snapshot[id] = t
 	}
@@ -1,40 +1,74 @@
 package runs
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestEnsureTestAndGetTest(t *testing.T) {
-	AllTests = make(map[int]*Test)
+	AllTests = make(map[string]*Test)
 
-	created := EnsureTest(10, func() *Test {
+	created := EnsureTest("10", func() *Test {
 		return &Test{}
 	})
 	if created == nil {
 		t.Fatal("expected created test, got nil")
 	}
 
-	second := EnsureTest(10, func() *Test {
+	second := EnsureTest("10", func() *Test {
 		return &Test{}
 	})
 	if created != second {
 		t.Fatal("expected EnsureTest to return existing test")
 	}
 
-	got, ok := GetTest(10)
+	got, ok := GetTest("10")
 	if !ok || got != created {
 		t.Fatal("expected GetTest to return created test")
 	}
 }
 
 func TestDeleteTest(t *testing.T) {
-	AllTests = make(map[int]*Test)
-	SetTest(5, &Test{})
+	AllTests = make(map[string]*Test)
+	SetTest("5", &Test{})
 
-	if _, ok := GetTest(5); !ok {
+	if _, ok := GetTest("5"); !ok {
 		t.Fatal("expected test to exist before delete")
 	}
 
-	DeleteTest(5)
-	if _, ok := GetTest(5); ok {
+	DeleteTest("5")
+	if _, ok := GetTest("5"); ok {
 		t.Fatal("expected test to be deleted")
 	}
 }
+
+func TestDeleteExpiredTests(t *testing.T) {
+	AllTests = make(map[string]*Test)
+
+	expired := EnsureTest("expired", func() *Test {
+		return &Test{
+			Created:     nowUTC().Add(-2 * cleanupAge),
+			CheckPoints: make(map[string]*Checkpoint),
+		}
+	})
+	cp := expired.EnsureCheckpoint("cp", CheckpointOptions{TargetCount: 2})
+
+	EnsureTest("active", func() *Test { return &Test{Created: nowUTC()} })
+
+	deleteExpiredTests(nowUTC().Add(-cleanupAge))
+
+	if _, ok := GetTest("expired"); ok {
+		t.Fatal("expected expired test to be deleted")
+	}
+	if _, ok := GetTest("active"); !ok {
+		t.Fatal("expected active test to be kept")
+	}
+
+	select {
+	case <-cp.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected checkpoint of expired test to be stopped")
+	}
+
+	DeleteTest("active")
+}
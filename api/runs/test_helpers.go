@@ -1,6 +1,11 @@
 package runs
 
-import "github.com/gorilla/websocket"
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
 
 // GetData returns test data safely.
 func (t *Test) GetData() []byte {
@@ -18,48 +23,173 @@ func (t *Test) SetData(data []byte) {
 	t.Data = data
 }
 
-// AddConnection appends a connection and returns its index.
-func (t *Test) AddConnection(conn *websocket.Conn) int {
+// AddConnection registers agent in connection registry.
+func (t *Test) AddConnection(agent *Agent) error {
+	if err := ValidateAgentID(agent.ID); err != nil {
+		return err
+	}
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	t.Connections = append(t.Connections, conn)
-	return len(t.Connections) - 1
+	if t.Connections == nil {
+		t.Connections = make(map[string]*Agent)
+	}
+
+	if _, ok := t.Connections[agent.ID]; ok {
+		return ErrAgentExists
+	}
+
+	t.Connections[agent.ID] = agent
+
+	return nil
 }
 
-// GetConnection returns a connection by index.
-func (t *Test) GetConnection(idx int) *websocket.Conn {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// agentDisconnected removes agent from elections as soon as its connection
+// closes, so a leader that is gone does not block the others.
+func (t *Test) agentDisconnected(agentID string) {
+	t.leaveElections(agentID)
+}
+
+// agentRemoved releases everything held by agent once it's removed from the
+// test, so a resumed session keeps its locks, permits, leases and tasks.
+func (t *Test) agentRemoved(agentID string) {
+	t.releaseLocks(agentID)
+	t.releaseSemaphores(agentID)
+	t.returnLeases(agentID)
+	t.requeueTasks(agentID)
+	t.unwatchAll(agentID)
+	t.unsubscribeAll(agentID)
+	t.ReleaseRole(agentID)
+}
+
+// DetachConnection marks agent as disconnected if conn is still its active
+// connection. Agent is kept for grace period so the session can be resumed,
+// afterwards it's removed. Non-positive grace removes agent immediately.
+func (t *Test) DetachConnection(
+	agentID string, conn *websocket.Conn, grace time.Duration,
+) {
+	agent := t.GetConnection(agentID)
+	if agent == nil || !agent.detach(conn) {
+		return
+	}
+
+	t.agentDisconnected(agentID)
+
+	if grace <= 0 {
+		t.expireAgent(agent)
+		return
+	}
+
+	agent.setExpiry(time.AfterFunc(grace, func() { t.expireAgent(agent) }))
+}
 
-	if idx < 0 || idx >= len(t.Connections) {
-		return nil
+// expireAgent removes agent unless it has resumed its session.
+func (t *Test) expireAgent(agent *Agent) {
+	t.mu.Lock()
+	if t.Connections[agent.ID] != agent || agent.Connected() {
+		t.mu.Unlock()
+		return
+	}
+
+	log.Debugf("Removing agent %q", agent.ID)
+	delete(t.Connections, agent.ID)
+	t.mu.Unlock()
+
+	t.agentRemoved(agent.ID)
+}
+
+// CanResume checks whether agent session can be resumed with provided token.
+func (t *Test) CanResume(agentID, token string) error {
+	agent := t.GetConnection(agentID)
+	if agent == nil {
+		return ErrSessionNotFound
+	}
+
+	if !agent.ValidResumeToken(token) {
+		return ErrInvalidResumeToken
+	}
+
+	return nil
+}
+
+// ResumeConnection attaches a new connection to an existing agent session. A
+// connection still held by the agent is closed and replaced. Queued messages
+// are delivered on next Flush or write.
+func (t *Test) ResumeConnection(
+	agentID, token string, conn *websocket.Conn,
+) (*Agent, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	agent, ok := t.Connections[agentID]
+	if !ok {
+		return nil, ErrSessionNotFound
 	}
 
-	return t.Connections[idx]
+	if !agent.ValidResumeToken(token) {
+		return nil, ErrInvalidResumeToken
+	}
+
+	if old := agent.attach(conn); old != nil {
+		old.Close() // nolint: errcheck, gosec
+	}
+
+	return agent, nil
 }
 
-// ConnectionCount returns the number of connections.
+// GetConnection returns an agent by ID.
+func (t *Test) GetConnection(agentID string) *Agent {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.Connections[agentID]
+}
+
+// ConnectionCount returns the number of connected agents.
 func (t *Test) ConnectionCount() int {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	return len(t.Connections)
+	count := 0
+	for _, agent := range t.Connections {
+		if agent.Connected() {
+			count++
+		}
+	}
+
+	return count
 }
 
-// GetConnectionsSnapshot returns a snapshot of connections.
-func (t *Test) GetConnectionsSnapshot() []*websocket.Conn {
+// GetConnectionsSnapshot returns a snapshot of agents keyed by agent ID,
+// including the ones waiting to resume their session.
+func (t *Test) GetConnectionsSnapshot() map[string]*Agent {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	conns := make([]*websocket.Conn, len(t.Connections))
-	copy(conns, t.Connections)
+	conns := make(map[string]*Agent, len(t.Connections))
+	for id, agent := range t.Connections {
+		conns[id] = agent
+	}
 
 	return conns
 }
 
-// EnsureCheckpoint gets or creates a checkpoint.
-func (t *Test) EnsureCheckpoint(identifier string, target int) *Checkpoint {
+// GetCheckpoint returns a checkpoint by identifier.
+func (t *Test) GetCheckpoint(identifier string) (*Checkpoint, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	cp, ok := t.CheckPoints[identifier]
+	return cp, ok
+}
+
+// EnsureCheckpoint gets or creates a checkpoint. Options are only applied
+// when a new checkpoint is created, start time set by SetCheckpointStart
+// takes precedence over the one in options.
+func (t *Test) EnsureCheckpoint(
+	identifier string, opts CheckpointOptions,
+) *Checkpoint {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -71,8 +201,84 @@ func (t *Test) EnsureCheckpoint(identifier string, target int) *Checkpoint {
 		t.CheckPoints = make(map[string]*Checkpoint)
 	}
 
-	cp := CreateCheckpoint(identifier, target, t)
+	if startAt, ok := t.checkpointStarts[identifier]; ok {
+		opts.StartAt = startAt
+		delete(t.checkpointStarts, identifier)
+	}
+
+	t.dropPassedCheckpointStarts()
+
+	cp := CreateCheckpoint(identifier, opts, t)
 	t.CheckPoints[identifier] = cp
 
 	return cp
 }
+
+// SetCheckpointStart sets absolute start time of a checkpoint. If checkpoint
+// does not exist yet, start time is applied once it's created.
+func (t *Test) SetCheckpointStart(identifier string, startAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if cp, ok := t.CheckPoints[identifier]; ok {
+		cp.SetStartAt(startAt)
+		return
+	}
+
+	if t.checkpointStarts == nil {
+		t.checkpointStarts = make(map[string]time.Time)
+	}
+
+	t.checkpointStarts[identifier] = startAt
+	t.dropPassedCheckpointStarts()
+}
+
+// dropPassedCheckpointStarts drops start times of checkpoints that were not
+// created before the start time passed, as they would not be applied anyway.
+// Must be called with t.mu held.
+func (t *Test) dropPassedCheckpointStarts() {
+	now := time.Now()
+	for identifier, startAt := range t.checkpointStarts {
+		if !startAt.After(now) {
+			delete(t.checkpointStarts, identifier)
+		}
+	}
+}
+
+// Close closes all test connections with a close frame, drops sessions
+// waiting to be resumed and stops checkpoints, locks and queues.
+func (t *Test) Close() {
+	t.mu.Lock()
+	agents := t.Connections
+	checkpoints := t.CheckPoints
+	locks := t.Locks
+	queues := t.Queues
+	t.Connections = make(map[string]*Agent)
+	t.CheckPoints = make(map[string]*Checkpoint)
+	t.checkpointStarts = nil
+	t.Locks = nil
+	t.Semaphores = nil
+	t.Elections = nil
+	t.Queues = nil
+	t.Channels = nil
+	t.watchers = nil
+	t.roleAssignments = nil
+	t.feeds = nil
+	t.mu.Unlock()
+
+	for _, cp := range checkpoints {
+		cp.Stop()
+	}
+
+	for _, l := range locks {
+		l.Stop()
+	}
+
+	for _, q := range queues {
+		q.Stop()
+	}
+
+	for _, agent := range agents {
+		agent.closeSession(websocket.CloseNormalClosure, "test deleted")
+	}
+}
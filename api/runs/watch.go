@@ -0,0 +1,111 @@
+package runs
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageDataChanged is pushed to agents watching a key once it changes.
+const MessageDataChanged = "data_changed"
+
+// DataChange describes content of data_changed messages.
+type DataChange struct {
+	KeyContent
+	// Deleted is set when key was removed, data is null then.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Watch subscribes agent to changes of a key within test. Request ID is
+// echoed in every data_changed message.
+func (t *Test) Watch(key, agentID, requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.watchers == nil {
+		t.watchers = make(map[string]map[string]string)
+	}
+
+	if t.watchers[key] == nil {
+		t.watchers[key] = make(map[string]string)
+	}
+
+	t.watchers[key][agentID] = requestID
+}
+
+// Unwatch stops agent watch of a key. Returns false if agent was not
+// watching it.
+func (t *Test) Unwatch(key, agentID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.watchers[key][agentID]; !ok {
+		return false
+	}
+
+	delete(t.watchers[key], agentID)
+	if len(t.watchers[key]) == 0 {
+		delete(t.watchers, key)
+	}
+
+	return true
+}
+
+// unwatchAll stops all watches of agent.
+func (t *Test) unwatchAll(agentID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, agents := range t.watchers {
+		delete(agents, agentID)
+		if len(agents) == 0 {
+			delete(t.watchers, key)
+		}
+	}
+}
+
+// notifyDataChanged pushes a data_changed message to agents watching key.
+func (t *Test) notifyDataChanged(key string, change DataChange) {
+	t.mu.RLock()
+	watchers := make(map[*Agent]string, len(t.watchers[key]))
+	for agentID, requestID := range t.watchers[key] {
+		if agent, ok := t.Connections[agentID]; ok {
+			watchers[agent] = requestID
+		}
+	}
+	t.mu.RUnlock()
+
+	for agent, requestID := range watchers {
+		if err := agent.Reply(requestID, MessageDataChanged, change); err != nil {
+			log.Errorf(
+				"Could not notify agent %q about change of key %q: %s",
+				agent.ID, key, err.Error(),
+			)
+		}
+	}
+}
+
+// notifyDataChanged notifies watchers of a key within test, if test is
+// active.
+func notifyDataChanged(testID, key string, data []byte, version int64) {
+	t, ok := GetTest(testID)
+	if !ok {
+		return
+	}
+
+	t.notifyDataChanged(key, DataChange{KeyContent: KeyContent{
+		Key:         key,
+		DataContent: NewDataContent(data, version),
+	}})
+}
+
+// notifyKeyDeleted notifies watchers of a key that it was removed.
+func notifyKeyDeleted(testID, key string) {
+	t, ok := GetTest(testID)
+	if !ok {
+		return
+	}
+
+	t.notifyDataChanged(key, DataChange{
+		KeyContent: KeyContent{Key: key, DataContent: NewDataContent(nil, 0)},
+		Deleted:    true,
+	})
+}
@@ -2,7 +2,10 @@ package ws
 
 import (
 	"encoding/json"
+	stderrors "errors"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/paulsgrudups/testsync/api/runs"
 	"github.com/paulsgrudups/testsync/wsutil"
 	"github.com/pkg/errors"
@@ -12,50 +15,1036 @@ import (
 const (
 	CommandReadData           = "read_data"
 	CommandUpdateData         = "update_data"
+	CommandCompareAndSet      = "compare_and_set"
+	CommandGetKey             = "get_key"
+	CommandSetKey             = "set_key"
+	CommandDeleteKey          = "delete_key"
+	CommandListKeys           = "list_keys"
+	CommandWatchData          = "watch_data"
+	CommandUnwatchData        = "unwatch_data"
+	CommandIncr               = "incr"
+	CommandDecr               = "decr"
+	CommandGetCounter         = "get_counter"
+	CommandLockAcquire        = "lock_acquire"
+	CommandLockRelease        = "lock_release"
+	CommandSemAcquire         = "sem_acquire"
+	CommandSemRelease         = "sem_release"
+	CommandElectLeader        = "elect_leader"
+	CommandClaimRole          = "claim_role"
+	CommandLeaseItem          = "lease_item"
+	CommandReturnItem         = "return_item"
+	CommandNextRow            = "next_row"
+	CommandQueuePush          = "queue_push"
+	CommandQueuePop           = runs.MessageQueuePop
+	CommandQueueAck           = "queue_ack"
+	CommandSubscribe          = "subscribe"
+	CommandUnsubscribe        = "unsubscribe"
+	CommandPublish            = "publish"
+	CommandSendTo             = "send_to"
+	CommandBroadcast          = "broadcast"
+	CommandTimeSync           = wsutil.CommandTimeSync
 	CommandGetConnectionCount = "get_connection_count"
 	CommandWaitCheckpoint     = "wait_checkpoint"
 	CommandClose              = "close"
+
+	// CommandRegistered is sent to the client once connection is registered,
+	// if it's requested on registration.
+	CommandRegistered = "registered"
+	// CommandDataChanged is pushed to agents watching changed data.
+	CommandDataChanged = runs.MessageDataChanged
+	// CommandLockGranted is pushed to a waiting agent once it obtains lock.
+	CommandLockGranted = runs.MessageLockGranted
+	// CommandLockExpired is pushed to lock holder once its lease expires.
+	CommandLockExpired = runs.MessageLockExpired
+	// CommandSemGranted is pushed to agent once it obtains a permit.
+	CommandSemGranted = runs.MessageSemaphoreGranted
+	// CommandLeaderChanged is pushed to election participants once a new
+	// leader is elected.
+	CommandLeaderChanged = runs.MessageLeaderChanged
+	// CommandLeaseExpired is pushed to agent once lease of a pool item
+	// expires.
+	CommandLeaseExpired = runs.MessageLeaseExpired
+	// CommandChannelMessage is pushed to agents subscribed to a channel.
+	CommandChannelMessage = runs.MessageChannel
+	// CommandMessage is pushed to agent addressed by send_to.
+	CommandMessage = runs.MessageDirect
+	// CommandBroadcastMessage is pushed to every connected agent once a
+	// message is broadcast.
+	CommandBroadcastMessage = runs.MessageBroadcast
 )
 
-func waitCheckPoint(b []byte, connIdx int, t *runs.Test) error {
+func waitCheckPoint(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
 	var check struct {
-		TargetCount int    `json:"target_count"`
-		Identifier  string `json:"identifier"`
+		TargetCount int             `json:"target_count"`
+		Identifier  string          `json:"identifier"`
+		TimeoutMS   int             `json:"timeout_ms"`
+		Cyclic      bool            `json:"cyclic"`
+		Payload     json.RawMessage `json:"payload"`
+		// StartDelayMS and StartAt are only applied by the agent creating
+		// the checkpoint.
+		StartDelayMS *int  `json:"start_delay_ms"`
+		StartAt      int64 `json:"start_at"`
 	}
 
-	err := json.Unmarshal(b, &check)
+	err := json.Unmarshal(m.Content.Bytes, &check)
 	if err != nil {
-		return errors.Wrap(err, "could not unmarshal checkpoint data")
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal checkpoint data"),
+		)
+	}
+
+	if err := validateName(check.Identifier); err != nil {
+		return err
+	}
+
+	if check.TargetCount < 1 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid checkpoint target count: %d", check.TargetCount),
+		)
+	}
+
+	if check.TimeoutMS < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid checkpoint timeout: %d", check.TimeoutMS),
+		)
+	}
+
+	opts := runs.CheckpointOptions{
+		TargetCount: check.TargetCount,
+		Timeout:     time.Duration(check.TimeoutMS) * time.Millisecond,
+		Cyclic:      check.Cyclic,
+	}
+
+	if check.StartDelayMS != nil {
+		if *check.StartDelayMS < 0 {
+			return newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Errorf("invalid checkpoint start delay: %d", *check.StartDelayMS),
+			)
+		}
+
+		delay := time.Duration(*check.StartDelayMS) * time.Millisecond
+		opts.StartDelay = &delay
+	}
+
+	if check.StartAt < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid checkpoint start time: %d", check.StartAt),
+		)
+	}
+
+	if check.StartAt > 0 {
+		opts.StartAt = time.UnixMilli(check.StartAt)
 	}
 
 	// check if provided indentifier is already used, if it's already assigned
 	// to test, then just add this connection. In case of a new identifier a
 	// checkpoint is created.
-	point := t.EnsureCheckpoint(check.Identifier, check.TargetCount)
-
-	finished := point.IsFinished()
-	if finished {
-		// checkpoint has already finished, send a notification about
-		// checkpoint's status.
-		err = wsutil.SendMessage(
-			t.GetConnection(connIdx),
-			"wait_checkpoint",
-			struct {
-				Command    string `json:"command"`
-				Identifier string `json:"identifier"`
-				Finished   bool   `json:"finished"`
-			}{
-				Command:    "wait_checkpoint",
-				Identifier: point.Identifier,
-				Finished:   finished,
-			},
-		)
-		if err != nil {
-			return errors.Wrap(err, "could not send checkpoint update")
+	point := t.EnsureCheckpoint(check.Identifier, opts)
+
+	if point.AddConnection(runs.CheckpointMember{
+		Waiter:  runs.Waiter{AgentID: agent.ID, RequestID: m.ID},
+		Payload: check.Payload,
+	}) {
+		return nil
+	}
+
+	// checkpoint has already finished or timed out, send a notification about
+	// checkpoint's status.
+	var status interface{} = struct {
+		Command    string `json:"command"`
+		Identifier string `json:"identifier"`
+		Finished   bool   `json:"finished"`
+		Generation int    `json:"generation"`
+	}{
+		Command:    CommandWaitCheckpoint,
+		Identifier: point.Identifier,
+		Finished:   point.IsFinished(),
+		Generation: point.GetGeneration(),
+	}
+	if point.IsTimedOut() {
+		status = point.TimeoutStatus()
+	}
+
+	err = agent.Reply(m.ID, CommandWaitCheckpoint, status)
+	if err != nil {
+		return errors.Wrap(err, "could not send checkpoint update")
+	}
+
+	return nil
+}
+
+func readData(
+	m wsutil.Message, data []byte, version int64, agent *runs.Agent,
+) error {
+	var opts struct {
+		Envelope bool `json:"envelope"`
+	}
+
+	if len(m.Content.Bytes) > 0 {
+		if err := json.Unmarshal(m.Content.Bytes, &opts); err != nil {
+			return newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Wrap(err, "could not unmarshal read options"),
+			)
 		}
 	}
 
-	point.AddConnection(connIdx)
+	// raw binary frame can't carry request ID, so requests with ID are always
+	// answered with an envelope.
+	if !opts.Envelope && m.ID == "" {
+		return agent.WriteMessage(websocket.BinaryMessage, data)
+	}
+
+	return agent.Reply(m.ID, CommandReadData, runs.NewDataContent(data, version))
+}
+
+// versionContent describes test data version sent in write acknowledgements.
+type versionContent struct {
+	Version int64 `json:"version"`
+}
+
+func compareAndSet(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	var cas struct {
+		ExpectedVersion *int64          `json:"expected_version"`
+		Data            json.RawMessage `json:"data"`
+	}
+
+	err := json.Unmarshal(m.Content.Bytes, &cas)
+	if err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal compare and set data"),
+		)
+	}
+
+	if cas.ExpectedVersion == nil || *cas.ExpectedVersion < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.New("non-negative expected_version is required"),
+		)
+	}
+
+	version, err := service.UpdateTestDataIfVersion(
+		testID, cas.Data, *cas.ExpectedVersion,
+	)
+	if err != nil {
+		if stderrors.Is(err, runs.ErrVersionMismatch) {
+			return newCommandError(ErrorCodeVersionMismatch, err)
+		}
+
+		return errors.Wrap(err, "could not store data")
+	}
+
+	return agent.Reply(m.ID, CommandCompareAndSet, versionContent{Version: version})
+}
+
+// keyRequest describes content of key commands.
+type keyRequest struct {
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data"`
+	// ExpectedVersion is only used by set_key, nil skips the version check.
+	ExpectedVersion *int64 `json:"expected_version"`
+}
+
+func parseKeyRequest(m wsutil.Message) (keyRequest, error) {
+	var req keyRequest
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return req, newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal key request"),
+		)
+	}
+
+	if err := runs.ValidateKey(req.Key); err != nil {
+		return req, newCommandError(
+			ErrorCodeInvalidContent, errors.Wrapf(err, "key %q", req.Key),
+		)
+	}
+
+	return req, nil
+}
+
+// keyError converts key service errors to command errors.
+func keyError(err error) error {
+	switch {
+	case stderrors.Is(err, runs.ErrKeyNotFound):
+		return newCommandError(ErrorCodeKeyNotFound, err)
+	case stderrors.Is(err, runs.ErrVersionMismatch):
+		return newCommandError(ErrorCodeVersionMismatch, err)
+	default:
+		return err
+	}
+}
+
+func getKey(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req, err := parseKeyRequest(m)
+	if err != nil {
+		return err
+	}
+
+	data, version, err := service.ReadKey(testID, req.Key)
+	if err != nil {
+		return keyError(err)
+	}
+
+	return agent.Reply(m.ID, CommandGetKey, runs.KeyContent{
+		Key:         req.Key,
+		DataContent: runs.NewDataContent(data, version),
+	})
+}
+
+func setKey(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req, err := parseKeyRequest(m)
+	if err != nil {
+		return err
+	}
+
+	expected := runs.AnyVersion
+	if req.ExpectedVersion != nil {
+		if *req.ExpectedVersion < 0 {
+			return newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Errorf("invalid expected version: %d", *req.ExpectedVersion),
+			)
+		}
+
+		expected = *req.ExpectedVersion
+	}
+
+	version, err := service.SetKey(testID, req.Key, req.Data, expected)
+	if err != nil {
+		return keyError(err)
+	}
+
+	return agent.Reply(m.ID, CommandSetKey, struct {
+		Key     string `json:"key"`
+		Version int64  `json:"version"`
+	}{Key: req.Key, Version: version})
+}
+
+func deleteKey(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req, err := parseKeyRequest(m)
+	if err != nil {
+		return err
+	}
+
+	if err := service.DeleteKey(testID, req.Key); err != nil {
+		return keyError(err)
+	}
+
+	return agent.Reply(m.ID, CommandDeleteKey, struct {
+		Key string `json:"key"`
+	}{Key: req.Key})
+}
+
+func listKeys(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	keys, err := service.ListKeys(testID)
+	if err != nil {
+		return errors.Wrap(err, "could not list keys")
+	}
+
+	return agent.Reply(m.ID, CommandListKeys, struct {
+		Keys []string `json:"keys"`
+	}{Keys: keys})
+}
+
+// watchKey returns key of watch commands, defaults to test data.
+func watchKey(m wsutil.Message) (string, error) {
+	var req struct {
+		Key string `json:"key"`
+	}
+
+	if len(m.Content.Bytes) > 0 {
+		if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+			return "", newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Wrap(err, "could not unmarshal watch request"),
+			)
+		}
+	}
+
+	if req.Key == "" {
+		return runs.DefaultKey, nil
+	}
+
+	if err := runs.ValidateKey(req.Key); err != nil {
+		return "", newCommandError(
+			ErrorCodeInvalidContent, errors.Wrapf(err, "key %q", req.Key),
+		)
+	}
+
+	return req.Key, nil
+}
+
+func watchData(
+	m wsutil.Message, testID string, agent *runs.Agent, t *runs.Test,
+	service *runs.Service,
+) error {
+	key, err := watchKey(m)
+	if err != nil {
+		return err
+	}
+
+	t.Watch(key, agent.ID, m.ID)
+
+	// current value is sent so the agent has a baseline to compare pushed
+	// versions to.
+	data, version, err := service.ReadKey(testID, key)
+	if err != nil && !stderrors.Is(err, runs.ErrKeyNotFound) {
+		return errors.Wrap(err, "could not load data")
+	}
+
+	return agent.Reply(m.ID, CommandWatchData, runs.KeyContent{
+		Key:         key,
+		DataContent: runs.NewDataContent(data, version),
+	})
+}
+
+func unwatchData(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	key, err := watchKey(m)
+	if err != nil {
+		return err
+	}
+
+	return agent.Reply(m.ID, CommandUnwatchData, struct {
+		Key     string `json:"key"`
+		Removed bool   `json:"removed"`
+	}{Key: key, Removed: t.Unwatch(key, agent.ID)})
+}
+
+// validateName checks name of a coordination primitive in command content.
+func validateName(name string) error {
+	if err := runs.ValidateName(name); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent, errors.Wrapf(err, "name %q", name),
+		)
+	}
+
+	return nil
+}
+
+func counter(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req := struct {
+		Name string `json:"name"`
+		By   int64  `json:"by"`
+	}{By: 1}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal counter request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	if m.Command != CommandGetCounter && req.By <= 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid counter step: %d", req.By),
+		)
+	}
+
+	var (
+		value int64
+		err   error
+	)
+
+	switch m.Command {
+	case CommandIncr:
+		value, err = service.AddCounter(testID, req.Name, req.By)
+	case CommandDecr:
+		value, err = service.AddCounter(testID, req.Name, -req.By)
+	default:
+		value, err = service.GetCounter(testID, req.Name)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not process counter")
+	}
+
+	return agent.Reply(m.ID, m.Command, runs.CounterValue{
+		Name: req.Name, Value: value,
+	})
+}
+
+func lockAcquire(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Name  string `json:"name"`
+		TTLMS int    `json:"ttl_ms"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal lock request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	if req.TTLMS < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid lock ttl: %d", req.TTLMS),
+		)
+	}
+
+	// agent is answered with lock_granted once it obtains the lock.
+	err := t.EnsureLock(req.Name).Acquire(runs.LockRequest{
+		Waiter: runs.Waiter{AgentID: agent.ID, RequestID: m.ID},
+		TTL:    time.Duration(req.TTLMS) * time.Millisecond,
+	})
+	if err != nil {
+		return newCommandError(ErrorCodeLockConflict, err)
+	}
 
 	return nil
 }
+
+func lockRelease(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal lock request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	lock, ok := t.GetLock(req.Name)
+	if !ok {
+		return newCommandError(ErrorCodeLockNotHeld, runs.ErrLockNotHeld)
+	}
+
+	if err := lock.Release(agent.ID); err != nil {
+		return newCommandError(ErrorCodeLockNotHeld, err)
+	}
+
+	return agent.Reply(m.ID, CommandLockRelease, struct {
+		Name string `json:"name"`
+	}{Name: req.Name})
+}
+
+func semAcquire(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Name    string `json:"name"`
+		Permits int    `json:"permits"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal semaphore request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	if req.Permits < 1 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid semaphore permit count: %d", req.Permits),
+		)
+	}
+
+	sem, err := t.EnsureSemaphore(req.Name, req.Permits)
+	if err != nil {
+		return newCommandError(ErrorCodeSemaphorePermits, err)
+	}
+
+	// agent is answered with sem_granted once it obtains a permit.
+	err = sem.Acquire(runs.SemaphoreRequest{
+		Waiter: runs.Waiter{AgentID: agent.ID, RequestID: m.ID},
+	})
+	if err != nil {
+		return newCommandError(ErrorCodeSemaphoreConflict, err)
+	}
+
+	return nil
+}
+
+func semRelease(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal semaphore request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	sem, ok := t.GetSemaphore(req.Name)
+	if !ok {
+		return newCommandError(ErrorCodeSemaphoreNotHeld, runs.ErrSemaphoreNotHeld)
+	}
+
+	if err := sem.Release(agent.ID); err != nil {
+		return newCommandError(ErrorCodeSemaphoreNotHeld, err)
+	}
+
+	return agent.Reply(m.ID, CommandSemRelease, struct {
+		Name string `json:"name"`
+	}{Name: req.Name})
+}
+
+func electLeader(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal election request"),
+		)
+	}
+
+	if err := validateName(req.Name); err != nil {
+		return err
+	}
+
+	status := t.EnsureElection(req.Name).Join(runs.Waiter{
+		AgentID:   agent.ID,
+		RequestID: m.ID,
+	})
+
+	return agent.Reply(m.ID, CommandElectLeader, status)
+}
+
+func claimRole(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if len(m.Content.Bytes) > 0 {
+		if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+			return newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Wrap(err, "could not unmarshal role request"),
+			)
+		}
+	}
+
+	assignment, err := t.ClaimRole(agent.ID, req.Role)
+	if err != nil {
+		return roleError(err)
+	}
+
+	return agent.Reply(m.ID, CommandClaimRole, assignment)
+}
+
+// roleError converts role errors to command errors.
+func roleError(err error) error {
+	switch {
+	case stderrors.Is(err, runs.ErrUnknownRole):
+		return newCommandError(ErrorCodeUnknownRole, err)
+	case stderrors.Is(err, runs.ErrRoleFull):
+		return newCommandError(ErrorCodeRoleFull, err)
+	case stderrors.Is(err, runs.ErrRoleConflict):
+		return newCommandError(ErrorCodeRoleConflict, err)
+	default:
+		return err
+	}
+}
+
+// poolRequest describes pool addressed by lease_item and return_item
+// commands.
+type poolRequest struct {
+	Pool    string `json:"pool"`
+	Global  bool   `json:"global"`
+	TTLMS   int    `json:"ttl_ms"`
+	LeaseID string `json:"lease_id"`
+}
+
+func parsePoolRequest(m wsutil.Message, testID string) (poolRequest, string, error) {
+	var req poolRequest
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return req, "", newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal pool request"),
+		)
+	}
+
+	if err := validateName(req.Pool); err != nil {
+		return req, "", err
+	}
+
+	if req.Global {
+		return req, runs.GlobalPool, nil
+	}
+
+	return req, testID, nil
+}
+
+func leaseItem(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req, poolTestID, err := parsePoolRequest(m, testID)
+	if err != nil {
+		return err
+	}
+
+	if req.TTLMS < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid lease ttl: %d", req.TTLMS),
+		)
+	}
+
+	lease, err := service.LeaseItem(poolTestID, req.Pool, runs.LeaseRequest{
+		Waiter: runs.Waiter{AgentID: agent.ID, RequestID: m.ID},
+		TestID: testID,
+		TTL:    time.Duration(req.TTLMS) * time.Millisecond,
+	})
+	if err != nil {
+		return poolError(err)
+	}
+
+	return agent.Reply(m.ID, CommandLeaseItem, lease)
+}
+
+func returnItem(
+	m wsutil.Message, testID string, agent *runs.Agent, service *runs.Service,
+) error {
+	req, poolTestID, err := parsePoolRequest(m, testID)
+	if err != nil {
+		return err
+	}
+
+	if err := service.ReturnItem(poolTestID, req.Pool, req.LeaseID); err != nil {
+		return poolError(err)
+	}
+
+	return agent.Reply(m.ID, CommandReturnItem, struct {
+		Pool    string `json:"pool"`
+		Global  bool   `json:"global,omitempty"`
+		LeaseID string `json:"lease_id"`
+	}{Pool: req.Pool, Global: req.Global, LeaseID: req.LeaseID})
+}
+
+// poolError converts pool errors to command errors.
+func poolError(err error) error {
+	switch {
+	case stderrors.Is(err, runs.ErrPoolNotFound):
+		return newCommandError(ErrorCodePoolNotFound, err)
+	case stderrors.Is(err, runs.ErrPoolExhausted):
+		return newCommandError(ErrorCodePoolExhausted, err)
+	case stderrors.Is(err, runs.ErrLeaseNotFound):
+		return newCommandError(ErrorCodeLeaseNotFound, err)
+	default:
+		return errors.Wrap(err, "could not process pool")
+	}
+}
+
+func nextRow(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Feed string `json:"feed"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal feed request"),
+		)
+	}
+
+	if err := validateName(req.Feed); err != nil {
+		return err
+	}
+
+	feed, ok := t.GetFeed(req.Feed)
+	if !ok {
+		return newCommandError(ErrorCodeFeedNotFound, runs.ErrFeedNotFound)
+	}
+
+	row, err := feed.Next()
+	if err != nil {
+		return newCommandError(ErrorCodeFeedExhausted, err)
+	}
+
+	return agent.Reply(m.ID, CommandNextRow, row)
+}
+
+// queueRequest describes content of queue commands.
+type queueRequest struct {
+	Queue     string          `json:"queue"`
+	Data      json.RawMessage `json:"data"`
+	TimeoutMS int             `json:"timeout_ms"`
+	TaskID    int64           `json:"task_id"`
+}
+
+func parseQueueRequest(m wsutil.Message) (queueRequest, error) {
+	var req queueRequest
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return req, newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal queue request"),
+		)
+	}
+
+	return req, validateName(req.Queue)
+}
+
+func queuePush(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseQueueRequest(m)
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(req.Data) {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.New("task must be a JSON document"),
+		)
+	}
+
+	task := t.EnsureQueue(req.Queue).Push(req.Data)
+	task.Data = nil
+
+	return agent.Reply(m.ID, CommandQueuePush, task)
+}
+
+func queuePop(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseQueueRequest(m)
+	if err != nil {
+		return err
+	}
+
+	if req.TimeoutMS < 0 {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid queue timeout: %d", req.TimeoutMS),
+		)
+	}
+
+	// agent is answered with queue_pop once it receives a task.
+	t.EnsureQueue(req.Queue).Pop(runs.PopRequest{
+		Waiter:  runs.Waiter{AgentID: agent.ID, RequestID: m.ID},
+		Timeout: time.Duration(req.TimeoutMS) * time.Millisecond,
+	})
+
+	return nil
+}
+
+func queueAck(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseQueueRequest(m)
+	if err != nil {
+		return err
+	}
+
+	q, ok := t.GetQueue(req.Queue)
+	if !ok {
+		return newCommandError(ErrorCodeTaskNotFound, runs.ErrTaskNotFound)
+	}
+
+	if err := q.Ack(agent.ID, req.TaskID); err != nil {
+		return newCommandError(ErrorCodeTaskNotFound, err)
+	}
+
+	return agent.Reply(m.ID, CommandQueueAck, runs.QueueTask{
+		Queue: req.Queue, TaskID: req.TaskID,
+	})
+}
+
+// channelRequest describes content of channel commands.
+type channelRequest struct {
+	Channel string          `json:"channel"`
+	Data    json.RawMessage `json:"data"`
+	History int             `json:"history"`
+}
+
+func parseChannelRequest(m wsutil.Message) (channelRequest, error) {
+	var req channelRequest
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return req, newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal channel request"),
+		)
+	}
+
+	if err := validateName(req.Channel); err != nil {
+		return req, err
+	}
+
+	if req.History < 0 {
+		return req, newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Errorf("invalid channel history size: %d", req.History),
+		)
+	}
+
+	return req, nil
+}
+
+func subscribe(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseChannelRequest(m)
+	if err != nil {
+		return err
+	}
+
+	channel := t.EnsureChannel(req.Channel)
+	channel.KeepHistory(req.History)
+
+	history := channel.Subscribe(runs.Waiter{
+		AgentID:   agent.ID,
+		RequestID: m.ID,
+	})
+
+	return agent.Reply(m.ID, CommandSubscribe, struct {
+		Channel string                `json:"channel"`
+		History []runs.ChannelMessage `json:"history"`
+	}{Channel: req.Channel, History: history})
+}
+
+func unsubscribe(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseChannelRequest(m)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	if channel, ok := t.GetChannel(req.Channel); ok {
+		removed = channel.Unsubscribe(agent.ID)
+	}
+
+	return agent.Reply(m.ID, CommandUnsubscribe, struct {
+		Channel string `json:"channel"`
+		Removed bool   `json:"removed"`
+	}{Channel: req.Channel, Removed: removed})
+}
+
+func publish(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	req, err := parseChannelRequest(m)
+	if err != nil {
+		return err
+	}
+
+	channel := t.EnsureChannel(req.Channel)
+	channel.KeepHistory(req.History)
+
+	msg, subscribers := channel.Publish(agent.ID, req.Data)
+
+	return agent.Reply(m.ID, CommandPublish, struct {
+		Channel     string `json:"channel"`
+		Seq         int64  `json:"seq"`
+		Subscribers int    `json:"subscribers"`
+	}{Channel: req.Channel, Seq: msg.Seq, Subscribers: subscribers})
+}
+
+func sendTo(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		runs.MessageTarget
+		Data json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal message request"),
+		)
+	}
+
+	if (req.AgentID == "") == (req.Role == "") {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.New("either agent_id or role of the target is required"),
+		)
+	}
+
+	if req.Ordinal != nil && req.Role == "" {
+		return newCommandError(
+			ErrorCodeInvalidContent, errors.New("ordinal requires target role"),
+		)
+	}
+
+	delivered, err := t.SendTo(agent.ID, req.MessageTarget, req.Data)
+	if err != nil {
+		return newCommandError(ErrorCodeAgentNotConnected, err)
+	}
+
+	return agent.Reply(m.ID, CommandSendTo, struct {
+		Delivered []string `json:"delivered"`
+	}{Delivered: delivered})
+}
+
+func broadcast(m wsutil.Message, agent *runs.Agent, t *runs.Test) error {
+	var req struct {
+		Data          json.RawMessage `json:"data"`
+		ExcludeSender bool            `json:"exclude_sender"`
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+		return newCommandError(
+			ErrorCodeInvalidContent,
+			errors.Wrap(err, "could not unmarshal broadcast request"),
+		)
+	}
+
+	recipients := t.Broadcast(
+		runs.BroadcastMessage{SenderID: agent.ID, Data: req.Data},
+		req.ExcludeSender,
+	)
+
+	return agent.Reply(m.ID, CommandBroadcast, struct {
+		Recipients int `json:"recipients"`
+	}{Recipients: recipients})
+}
+
+// timeSync replies with server receive and send timestamps, echoing client
+// send timestamp, so agent can estimate its clock offset. Received is the time
+// the message was read from the connection.
+func timeSync(m wsutil.Message, agent *runs.Agent, received time.Time) error {
+	var req wsutil.TimeSync
+	if len(m.Content.Bytes) > 0 {
+		if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+			return newCommandError(
+				ErrorCodeInvalidContent,
+				errors.Wrap(err, "could not unmarshal time_sync request"),
+			)
+		}
+	}
+
+	req.ServerReceive = received.UnixMicro()
+	req.ServerSend = time.Now().UnixMicro()
+
+	return agent.Reply(m.ID, CommandTimeSync, req)
+}
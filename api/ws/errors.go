@@ -0,0 +1,127 @@
+package ws
+
+import (
+	stderrors "errors"
+
+	"github.com/paulsgrudups/testsync/api/runs"
+	log "github.com/sirupsen/logrus"
+)
+
+// CommandError is the command used for error replies.
+const CommandError = "error"
+
+// ErrorCode... describes error codes sent to the client in error replies.
+const (
+	// ErrorCodeInvalidMessage - message is not a valid JSON command message.
+	ErrorCodeInvalidMessage = "invalid_message"
+	// ErrorCodeUnknownCommand - command is not supported.
+	ErrorCodeUnknownCommand = "unknown_command"
+	// ErrorCodeInvalidContent - command content is malformed or has invalid
+	// values.
+	ErrorCodeInvalidContent = "invalid_content"
+	// ErrorCodeConnectionNotFound - agent connection is not registered to
+	// the test.
+	ErrorCodeConnectionNotFound = "connection_not_found"
+	// ErrorCodeVersionMismatch - test data version does not match the expected
+	// one.
+	ErrorCodeVersionMismatch = "version_mismatch"
+	// ErrorCodeKeyNotFound - requested key is not stored within the test.
+	ErrorCodeKeyNotFound = "key_not_found"
+	// ErrorCodeLockConflict - agent already holds or waits for the lock.
+	ErrorCodeLockConflict = "lock_conflict"
+	// ErrorCodeLockNotHeld - agent neither holds nor waits for the lock.
+	ErrorCodeLockNotHeld = "lock_not_held"
+	// ErrorCodeSemaphoreConflict - agent already holds or waits for a permit.
+	ErrorCodeSemaphoreConflict = "sem_conflict"
+	// ErrorCodeSemaphoreNotHeld - agent neither holds nor waits for a permit.
+	ErrorCodeSemaphoreNotHeld = "sem_not_held"
+	// ErrorCodeSemaphorePermits - semaphore exists with a different permit
+	// count.
+	ErrorCodeSemaphorePermits = "sem_permits_mismatch"
+	// ErrorCodeUnknownRole - role is not defined for the test.
+	ErrorCodeUnknownRole = "unknown_role"
+	// ErrorCodeRoleFull - all slots of the role are taken.
+	ErrorCodeRoleFull = "role_full"
+	// ErrorCodeRoleConflict - agent already holds another role.
+	ErrorCodeRoleConflict = "role_conflict"
+	// ErrorCodePoolNotFound - resource pool does not exist.
+	ErrorCodePoolNotFound = "pool_not_found"
+	// ErrorCodePoolExhausted - all items of the pool are leased.
+	ErrorCodePoolExhausted = "pool_exhausted"
+	// ErrorCodeLeaseNotFound - lease is not active, e.g. it has expired.
+	ErrorCodeLeaseNotFound = "lease_not_found"
+	// ErrorCodeFeedNotFound - feed is not uploaded for the test.
+	ErrorCodeFeedNotFound = "feed_not_found"
+	// ErrorCodeFeedExhausted - there are no unconsumed rows left in the feed.
+	ErrorCodeFeedExhausted = "feed_exhausted"
+	// ErrorCodeTaskNotFound - task is not delivered to the agent or was
+	// already acknowledged.
+	ErrorCodeTaskNotFound = "task_not_found"
+	// ErrorCodeAgentNotConnected - no agent addressed by the message is
+	// connected.
+	ErrorCodeAgentNotConnected = "agent_not_connected"
+	// ErrorCodeInternal - server failed to process a valid command.
+	ErrorCodeInternal = "internal_error"
+)
+
+// commandError describes a failed command with an error code for the client.
+type commandError struct {
+	code string
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// newCommandError wraps err with provided error code.
+func newCommandError(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &commandError{code: code, err: err}
+}
+
+// errorCode returns error code of provided error, defaults to internal error.
+func errorCode(err error) string {
+	var cmdErr *commandError
+	if stderrors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+
+	return ErrorCodeInternal
+}
+
+// sendError sends an error reply to the agent.
+func sendError(agent *runs.Agent, command, requestID string, err error) {
+	if agent == nil {
+		return
+	}
+
+	// details of internal errors, e.g. storage ones, are not exposed to the
+	// client, they are logged by the caller.
+	code, message := errorCode(err), err.Error()
+	if code == ErrorCodeInternal {
+		message = "internal error"
+	}
+
+	sendErr := agent.Reply(requestID, CommandError, struct {
+		Command   string `json:"command"`
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id,omitempty"`
+	}{
+		Command:   command,
+		Code:      code,
+		Message:   message,
+		RequestID: requestID,
+	})
+	if sendErr != nil {
+		log.Errorf("Could not send error reply: %s", sendErr.Error())
+	}
+}
@@ -2,10 +2,10 @@ package ws
 
 import (
 	"encoding/json"
+	"time"
 
 	stderrors "errors"
 
-	"github.com/gorilla/websocket"
 	"github.com/paulsgrudups/testsync/api/runs"
 	"github.com/paulsgrudups/testsync/wsutil"
 	"github.com/pkg/errors"
@@ -27,27 +27,48 @@ func NewCommandHandler(service *runs.Service) *CommandHandler {
 	return &CommandHandler{service: service}
 }
 
-// Handle processes a single WebSocket message.
-func (h *CommandHandler) Handle(testID int, connIdx int, body []byte, t *runs.Test) error {
+// Handle processes a single WebSocket message read at received time. If
+// processing fails, an error reply is sent to the agent and the error is
+// returned.
+func (h *CommandHandler) Handle(
+	testID string, agentID string, body []byte, received time.Time, t *runs.Test,
+) error {
 	var m wsutil.Message
-	if err := json.Unmarshal(body, &m); err != nil {
-		return errors.Wrap(err, "could not unmarshal message")
+
+	err := json.Unmarshal(body, &m)
+	if err != nil {
+		err = newCommandError(
+			ErrorCodeInvalidMessage,
+			errors.Wrap(err, "could not unmarshal message"),
+		)
+	} else {
+		err = h.handle(testID, agentID, m, received, t)
 	}
 
+	if err != nil {
+		sendError(t.GetConnection(agentID), m.Command, m.ID, err)
+	}
+
+	return err
+}
+
+func (h *CommandHandler) handle(
+	testID string, agentID string, m wsutil.Message, received time.Time, t *runs.Test,
+) error {
 	log.WithFields(log.Fields{
 		"test_id":  testID,
-		"conn_idx": connIdx,
+		"agent_id": agentID,
 		"command":  m.Command,
 	}).Debug("WS command received")
 
+	conn, err := getConn(t, agentID)
+	if err != nil {
+		return err
+	}
+
 	switch m.Command {
 	case CommandReadData:
-		conn, err := getConn(t, connIdx)
-		if err != nil {
-			return err
-		}
-
-		data, err := h.service.ReadTestData(testID)
+		data, version, err := h.service.ReadTestDataVersion(testID)
 		if err != nil && stderrors.Is(err, runs.ErrTestNotFound) {
 			data = t.GetData()
 			err = nil
@@ -56,48 +77,124 @@ func (h *CommandHandler) Handle(testID int, connIdx int, body []byte, t *runs.Te
 			return errors.Wrap(err, "could not load data")
 		}
 
-		return conn.WriteMessage(websocket.BinaryMessage, data)
+		return readData(m, data, version, conn)
 	case CommandUpdateData:
-		if err := h.service.UpdateTestData(testID, m.Content.Bytes); err != nil {
+		version, err := h.service.UpdateTestData(testID, m.Content.Bytes)
+		if err != nil {
 			return errors.Wrap(err, "could not store data")
 		}
 
-		return nil
-	case CommandGetConnectionCount:
-		conn, err := getConn(t, connIdx)
-		if err != nil {
-			return err
+		// update is acknowledged only when client is able to correlate it.
+		if m.ID == "" {
+			return nil
 		}
 
-		return wsutil.SendMessage(
-			conn,
+		return conn.Reply(m.ID, CommandUpdateData, versionContent{Version: version})
+	case CommandCompareAndSet:
+		return compareAndSet(m, testID, conn, h.service)
+	case CommandGetKey, CommandSetKey, CommandDeleteKey, CommandListKeys:
+		return h.handleKey(m, testID, conn)
+	case CommandWatchData:
+		return watchData(m, testID, conn, t, h.service)
+	case CommandUnwatchData:
+		return unwatchData(m, conn, t)
+	case CommandIncr, CommandDecr, CommandGetCounter:
+		return counter(m, testID, conn, h.service)
+	case CommandLockAcquire:
+		return lockAcquire(m, conn, t)
+	case CommandLockRelease:
+		return lockRelease(m, conn, t)
+	case CommandSemAcquire:
+		return semAcquire(m, conn, t)
+	case CommandSemRelease:
+		return semRelease(m, conn, t)
+	case CommandElectLeader:
+		return electLeader(m, conn, t)
+	case CommandClaimRole:
+		return claimRole(m, conn, t)
+	case CommandLeaseItem:
+		return leaseItem(m, testID, conn, h.service)
+	case CommandReturnItem:
+		return returnItem(m, testID, conn, h.service)
+	case CommandNextRow:
+		return nextRow(m, conn, t)
+	case CommandQueuePush, CommandQueuePop, CommandQueueAck:
+		return h.handleQueue(m, conn, t)
+	case CommandSubscribe, CommandUnsubscribe, CommandPublish:
+		return h.handleChannel(m, conn, t)
+	case CommandSendTo:
+		return sendTo(m, conn, t)
+	case CommandBroadcast:
+		return broadcast(m, conn, t)
+	case CommandTimeSync:
+		return timeSync(m, conn, received)
+	case CommandGetConnectionCount:
+		return conn.Reply(
+			m.ID,
 			CommandGetConnectionCount,
 			struct {
 				Count int `json:"count"`
 			}{Count: t.ConnectionCount()},
 		)
 	case CommandWaitCheckpoint:
-		if _, err := getConn(t, connIdx); err != nil {
-			return err
-		}
-
-		return waitCheckPoint(m.Content.Bytes, connIdx, t)
+		return waitCheckPoint(m, conn, t)
 	case CommandClose:
-		conn, err := getConn(t, connIdx)
-		if err != nil {
-			return err
-		}
-
 		return conn.Close()
 	default:
-		return errors.Errorf("received non existing command: %s", m.Command)
+		return newCommandError(
+			ErrorCodeUnknownCommand,
+			errors.Errorf("received non existing command: %s", m.Command),
+		)
+	}
+}
+
+func (h *CommandHandler) handleKey(
+	m wsutil.Message, testID string, conn *runs.Agent,
+) error {
+	switch m.Command {
+	case CommandGetKey:
+		return getKey(m, testID, conn, h.service)
+	case CommandSetKey:
+		return setKey(m, testID, conn, h.service)
+	case CommandDeleteKey:
+		return deleteKey(m, testID, conn, h.service)
+	default:
+		return listKeys(m, testID, conn, h.service)
+	}
+}
+
+func (h *CommandHandler) handleQueue(
+	m wsutil.Message, conn *runs.Agent, t *runs.Test,
+) error {
+	switch m.Command {
+	case CommandQueuePush:
+		return queuePush(m, conn, t)
+	case CommandQueuePop:
+		return queuePop(m, conn, t)
+	default:
+		return queueAck(m, conn, t)
 	}
 }
 
-func getConn(t *runs.Test, idx int) (*websocket.Conn, error) {
-	conn := t.GetConnection(idx)
+func (h *CommandHandler) handleChannel(
+	m wsutil.Message, conn *runs.Agent, t *runs.Test,
+) error {
+	switch m.Command {
+	case CommandSubscribe:
+		return subscribe(m, conn, t)
+	case CommandUnsubscribe:
+		return unsubscribe(m, conn, t)
+	default:
+		return publish(m, conn, t)
+	}
+}
+
+func getConn(t *runs.Test, agentID string) (*runs.Agent, error) {
+	conn := t.GetConnection(agentID)
 	if conn == nil {
-		return nil, errors.New("connection not found")
+		return nil, newCommandError(
+			ErrorCodeConnectionNotFound, errors.New("connection not found"),
+		)
 	}
 
 	return conn, nil
@@ -2,6 +2,8 @@ package ws
 
 import (
 	"fmt"
+
+	stderrors "errors"
 	"net/http"
 	"time"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/paulsgrudups/testsync/api/runs"
 	"github.com/paulsgrudups/testsync/utils"
+	"github.com/paulsgrudups/testsync/wsutil"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,9 +20,19 @@ var (
 	// SyncClient defines sync client credentials.
 	SyncClient utils.BasicCredentials
 
+	// ResumeGracePeriod defines how long a disconnected agent is kept so it
+	// can resume its session. Non-positive value disables session resume.
+	ResumeGracePeriod = 30 * time.Second
+
 	upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
 )
 
+// Headers set on handshake response with the registered agent session.
+const (
+	agentIDHeader     = "X-Agent-Id"
+	resumeTokenHeader = "X-Resume-Token"
+)
+
 func newWSRouter(s *Server) http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
 
@@ -34,7 +47,7 @@ func newWSRouter(s *Server) http.Handler {
 }
 
 func (s *Server) register(r *mux.Router) {
-	r.HandleFunc(`/{testID:\d+}`, s.registerWS).
+	r.HandleFunc(`/{testID}`, s.registerWS).
 		Name("registerWebSocket").
 		Methods(http.MethodGet)
 }
@@ -46,24 +59,196 @@ func (s *Server) registerWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	testID, err := runs.GetPathID(w, r, "testID")
+	if err != nil {
+		log.Errorf("Could not get path ID: %s", err.Error())
+		return
+	}
+
+	t := s.commandHandler().service.EnsureTest(testID)
+
+	agentID := r.URL.Query().Get("agent_id")
+	resumeToken := r.URL.Query().Get("resume_token")
+	resumed := resumeToken != ""
+	announce := r.URL.Query().Get("registration_message") == "true"
+	registered, claimedRole := false, false
+
+	// role claimed on registration is released if agent does not get
+	// registered. Only a claim made by this registration is released, so a
+	// concurrent registration of the same agent keeps its slot.
+	defer func() {
+		if claimedRole && !registered {
+			t.ReleaseRole(agentID)
+		}
+	}()
+
+	if resumed {
+		if !canResume(w, t, agentID, resumeToken) {
+			return
+		}
+	} else {
+		if agentID == "" {
+			agentID = runs.NewAgentID()
+		}
+
+		if !canRegister(w, t, agentID) {
+			return
+		}
+
+		if role := r.URL.Query().Get("role"); role != "" {
+			if !claimRegistrationRole(w, t, agentID, role) {
+				return
+			}
+
+			claimedRole = true
+		}
+
+		resumeToken = runs.NewResumeToken()
+	}
+
+	var role *runs.RoleAssignment
+	if assignment, ok := t.AgentRole(agentID); ok {
+		role = &assignment
+	}
+
+	conn, err := upgrader.Upgrade(w, r, http.Header{
+		agentIDHeader:     {agentID},
+		resumeTokenHeader: {resumeToken},
+	})
 	if err != nil {
 		log.Errorf("Failed to upgrade connection: %s", err.Error())
 		return
 	}
 
-	log.Info("Connection established to WebSocket")
+	// registration message is sent before agent is registered, so it's
+	// always the first message and precedes messages queued for the session.
+	if announce {
+		err = wsutil.SendMessage(conn, CommandRegistered, struct {
+			AgentID     string               `json:"agent_id"`
+			ResumeToken string               `json:"resume_token"`
+			Resumed     bool                 `json:"resumed"`
+			Role        *runs.RoleAssignment `json:"role,omitempty"`
+		}{
+			AgentID:     agentID,
+			ResumeToken: resumeToken,
+			Resumed:     resumed,
+			Role:        role,
+		})
+		if err != nil {
+			log.Errorf("Could not send registration message: %s", err.Error())
+			conn.Close() // nolint: errcheck, gosec
+			return
+		}
+	}
 
-	testID, err := runs.GetPathID(w, r, "testID")
+	var agent *runs.Agent
+	if resumed {
+		agent, err = t.ResumeConnection(agentID, resumeToken, conn)
+	} else {
+		agent = runs.NewAgent(agentID, resumeToken, conn)
+		err = t.AddConnection(agent)
+	}
 	if err != nil {
-		log.Errorf("Could not get path ID: %s", err.Error())
+		log.Errorf("Could not register agent %q: %s", agentID, err.Error())
+		conn.WriteMessage( // nolint: errcheck, gosec
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(
+				websocket.ClosePolicyViolation, err.Error(),
+			),
+		)
+		conn.Close() // nolint: errcheck, gosec
 		return
 	}
 
-	go s.reader(conn, testID)
+	registered = true
+
+	if err := agent.Flush(); err != nil {
+		log.Errorf("Could not deliver queued messages: %s", err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"test_id":  testID,
+		"agent_id": agentID,
+	}).Info("Connection established to WebSocket")
+
+	go s.reader(agent, conn, testID, t)
+}
+
+// canResume validates session resume request and writes HTTP error if the
+// session can not be resumed.
+func canResume(
+	w http.ResponseWriter, t *runs.Test, agentID, resumeToken string,
+) bool {
+	err := t.CanResume(agentID, resumeToken)
+	switch {
+	case err == nil:
+		return true
+	case stderrors.Is(err, runs.ErrInvalidResumeToken):
+		utils.HTTPError(w, "Invalid resume token", http.StatusForbidden)
+	default:
+		utils.HTTPError(
+			w,
+			fmt.Sprintf("Session for agent %q has expired", agentID),
+			http.StatusGone,
+		)
+	}
+
+	return false
 }
 
-func (s *Server) reader(conn *websocket.Conn, testID int) {
+// canRegister validates new agent ID and writes HTTP error if agent can not
+// be registered.
+func canRegister(w http.ResponseWriter, t *runs.Test, agentID string) bool {
+	if err := runs.ValidateAgentID(agentID); err != nil {
+		utils.HTTPError(
+			w, fmt.Sprintf("Invalid agent ID %q", agentID), http.StatusBadRequest,
+		)
+		return false
+	}
+
+	if t.GetConnection(agentID) != nil {
+		utils.HTTPError(
+			w,
+			fmt.Sprintf("Agent %q is already registered", agentID),
+			http.StatusConflict,
+		)
+		return false
+	}
+
+	return true
+}
+
+// claimRegistrationRole assigns role requested on registration and writes
+// HTTP error if role can't be assigned.
+func claimRegistrationRole(
+	w http.ResponseWriter, t *runs.Test, agentID, role string,
+) bool {
+	_, err := t.ClaimNewRole(agentID, role)
+	switch {
+	case err == nil:
+		return true
+	case stderrors.Is(err, runs.ErrUnknownRole):
+		utils.HTTPError(
+			w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest,
+		)
+	case stderrors.Is(err, runs.ErrRoleFull):
+		utils.HTTPError(
+			w, fmt.Sprintf("Role %q has no free slots", role), http.StatusConflict,
+		)
+	default:
+		utils.HTTPError(
+			w, fmt.Sprintf("Could not assign role %q", role), http.StatusConflict,
+		)
+	}
+
+	return false
+}
+
+func (s *Server) reader(
+	agent *runs.Agent, conn *websocket.Conn, testID string, r *runs.Test,
+) {
+	defer r.DetachConnection(agent.ID, conn, ResumeGracePeriod)
+
 	closeC := make(chan bool)
 	defer close(closeC)
 
@@ -73,7 +258,11 @@ func (s *Server) reader(conn *websocket.Conn, testID int) {
 			case <-closeC:
 				return
 			case <-time.After(10 * time.Second):
-				err := conn.WriteMessage(websocket.PingMessage, []byte("ping"))
+				err := conn.WriteControl(
+					websocket.PingMessage,
+					[]byte("ping"),
+					time.Now().Add(5*time.Second),
+				)
 				if err != nil {
 					log.Errorf(
 						"Could not send WS ping message: %s", err.Error(),
@@ -83,27 +272,18 @@ func (s *Server) reader(conn *websocket.Conn, testID int) {
 		}
 	}()
 
-	r := runs.EnsureTest(testID, func() *runs.Test {
-		return &runs.Test{
-			Created:     time.Now(),
-			Connections: []*websocket.Conn{},
-			CheckPoints: make(map[string]*runs.Checkpoint),
-		}
-	})
-
-	idx := r.AddConnection(conn)
-
 	for {
 		messageType, p, err := conn.ReadMessage()
+		received := time.Now()
 		if err != nil {
 			if messageType != -1 {
 				log.Errorf(
-					"Failed to read message for %d test: %s",
+					"Failed to read message for %s test: %s",
 					testID, err.Error(),
 				)
 			} else {
 				log.Infof(
-					"WS connection closed for %d test: %s",
+					"WS connection closed for %s test: %s",
 					testID, err.Error(),
 				)
 			}
@@ -115,12 +295,7 @@ func (s *Server) reader(conn *websocket.Conn, testID int) {
 
 		log.Infof("Received message: %s", string(p))
 
-		handler := s.Handler
-		if handler == nil {
-			handler = NewCommandHandler(nil)
-		}
-
-		err = handler.Handle(testID, idx, p, r)
+		err = s.commandHandler().Handle(testID, agent.ID, p, received, r)
 		if err != nil {
 			log.Errorf("Failed to process message: %s", err.Error())
 		}
@@ -2,6 +2,8 @@ package ws
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -14,19 +16,9 @@ import (
 )
 
 func TestWebSocketCommands(t *testing.T) {
-	runs.AllTests = make(map[int]*runs.Test)
-	runs.SetDataStore(storage.NewMemoryStore())
-	runs.DefaultService = runs.NewService(nil)
+	httpServer, _ := newTestServer(t)
 
-	server := &Server{Handler: NewCommandHandler(nil)}
-	httpServer := httptest.NewServer(newWSRouter(server))
-	defer httpServer.Close()
-
-	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/register/1"
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		t.Fatalf("failed to dial ws: %v", err)
-	}
+	conn, _ := dialWS(t, httpServer.URL, "/register/1")
 	defer conn.Close()
 
 	updatePayload := map[string]string{"data": "value"}
@@ -102,16 +94,1518 @@ func TestWebSocketCommands(t *testing.T) {
 	}
 }
 
-func writeWS(conn *websocket.Conn, command string, content interface{}) error {
-	body, err := json.Marshal(content)
+func TestRegisterAgentID(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, reg := dialWS(t, httpServer.URL, "/register/3?agent_id=agent-1")
+	if reg.AgentID != "agent-1" {
+		t.Fatalf("unexpected agent ID: %q", reg.AgentID)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") +
+		"/register/3?agent_id=agent-1"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected duplicate agent registration to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected conflict response, got %+v", resp)
+	}
+
+	test, ok := runs.GetTest("3")
+	if !ok || test.ConnectionCount() != 1 {
+		t.Fatal("expected a single registered connection")
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return test.ConnectionCount() == 0 })
+
+	// registration message is only sent when requested.
+	plain, resp, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(httpServer.URL, "http")+"/register/3?agent_id=agent-2",
+		nil,
+	)
 	if err != nil {
-		return err
+		t.Fatalf("failed to dial ws: %v", err)
+	}
+	defer plain.Close()
+
+	if resp.Header.Get(agentIDHeader) != "agent-2" {
+		t.Fatalf("unexpected agent ID header: %q", resp.Header.Get(agentIDHeader))
+	}
+
+	if err := writeWS(plain, CommandGetConnectionCount, map[string]string{}); err != nil {
+		t.Fatalf("get_connection_count failed: %v", err)
+	}
+
+	var count struct {
+		Count int `json:"count"`
+	}
+	readWS(t, plain, CommandGetConnectionCount, &count)
+}
+
+// newTestServer starts a WS server backed by its own service and memory
+// store. Tests registered meanwhile are closed and removed once the test ends.
+func newTestServer(t *testing.T) (*httptest.Server, *runs.Service) {
+	t.Helper()
+
+	service := runs.NewService(storage.NewMemoryStore())
+	httpServer := httptest.NewServer(
+		newWSRouter(&Server{Handler: NewCommandHandler(service)}),
+	)
+
+	t.Cleanup(func() {
+		httpServer.Close()
+		runs.RangeTests(func(id string, test *runs.Test) {
+			runs.DeleteTest(id)
+			test.Close()
+		})
+	})
+
+	return httpServer, service
+}
+
+type registration struct {
+	AgentID     string               `json:"agent_id"`
+	ResumeToken string               `json:"resume_token"`
+	Resumed     bool                 `json:"resumed"`
+	Role        *runs.RoleAssignment `json:"role"`
+}
+
+// dialWS connects to test server requesting registration message and
+// consumes it, returning the connection and its registration details.
+func dialWS(t *testing.T, serverURL, path string) (*websocket.Conn, registration) {
+	t.Helper()
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
 
-	message, err := json.Marshal(wsutil.Message{Command: command, Content: wsutil.RawMessage{Bytes: body}})
+	wsURL := "ws" + strings.TrimPrefix(serverURL, "http") + path +
+		separator + "registration_message=true"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
-		return err
+		t.Fatalf("failed to dial ws: %v", err)
 	}
 
-	return conn.WriteMessage(websocket.TextMessage, message)
+	var reg registration
+	readWS(t, conn, CommandRegistered, &reg)
+
+	return conn, reg
+}
+
+// readWS reads next message, checks its command and decodes its content.
+func readWS(t *testing.T, conn *websocket.Conn, command string, content interface{}) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s message failed: %v", command, err)
+	}
+
+	var m wsutil.Message
+	if err := json.Unmarshal(msg, &m); err != nil {
+		t.Fatalf("failed to unmarshal %s msg: %v", command, err)
+	}
+	if m.Command != command {
+		t.Fatalf("unexpected command: %s, expected %s", m.Command, command)
+	}
+
+	if err := json.Unmarshal(m.Content.Bytes, content); err != nil {
+		t.Fatalf("failed to parse %s payload: %v", command, err)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	first, reg := dialWS(t, httpServer.URL, "/register/4")
+	if reg.ResumeToken == "" || reg.Resumed {
+		t.Fatalf("unexpected registration: %+v", reg)
+	}
+
+	if err := writeWS(first, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "resume",
+		"target_count": 2,
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+
+	test, _ := runs.GetTest("4")
+	waitFor(t, func() bool {
+		cp, ok := test.GetCheckpoint("resume")
+		return ok && len(cp.Participants()) == 1
+	})
+
+	first.Close()
+	waitFor(t, func() bool { return test.ConnectionCount() == 0 })
+
+	// checkpoint is released while first agent is away.
+	second, _ := dialWS(t, httpServer.URL, "/register/4")
+	defer second.Close()
+
+	if err := writeWS(second, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "resume",
+		"target_count": 2,
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+
+	var status struct {
+		Finished bool `json:"finished"`
+	}
+	readWS(t, second, CommandWaitCheckpoint, &status)
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") +
+		"/register/4?agent_id=" + reg.AgentID + "&resume_token=bad"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil ||
+		resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected invalid token to be rejected, got %+v", resp)
+	}
+
+	resumed, resumedReg := dialWS(
+		t, httpServer.URL,
+		"/register/4?agent_id="+reg.AgentID+"&resume_token="+reg.ResumeToken,
+	)
+	defer resumed.Close()
+
+	if !resumedReg.Resumed || resumedReg.AgentID != reg.AgentID {
+		t.Fatalf("unexpected resumed registration: %+v", resumedReg)
+	}
+
+	readWS(t, resumed, CommandWaitCheckpoint, &status)
+	if !status.Finished {
+		t.Fatal("expected queued checkpoint release to be delivered")
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/5")
+	defer conn.Close()
+
+	type errorReply struct {
+		Command   string `json:"command"`
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	}
+
+	cases := []struct {
+		name    string
+		message string
+		want    errorReply
+	}{
+		{
+			name:    "invalid message",
+			message: `{"command":`,
+			want:    errorReply{Code: ErrorCodeInvalidMessage},
+		},
+		{
+			name:    "unknown command",
+			message: `{"id":"req-1","command":"missing","content":{}}`,
+			want: errorReply{
+				Command: "missing", Code: ErrorCodeUnknownCommand, RequestID: "req-1",
+			},
+		},
+		{
+			name:    "invalid checkpoint",
+			message: `{"id":"req-2","command":"wait_checkpoint","content":{"identifier":"cp","target_count":"2"}}`,
+			want: errorReply{
+				Command:   CommandWaitCheckpoint,
+				Code:      ErrorCodeInvalidContent,
+				RequestID: "req-2",
+			},
+		},
+		{
+			name:    "invalid checkpoint identifier",
+			message: `{"id":"req-4","command":"wait_checkpoint","content":{"identifier":"a/b","target_count":2}}`,
+			want: errorReply{
+				Command:   CommandWaitCheckpoint,
+				Code:      ErrorCodeInvalidContent,
+				RequestID: "req-4",
+			},
+		},
+		{
+			name:    "invalid checkpoint start delay",
+			message: `{"id":"req-3","command":"wait_checkpoint","content":{"identifier":"cp","target_count":2,"start_delay_ms":-1}}`,
+			want: errorReply{
+				Command:   CommandWaitCheckpoint,
+				Code:      ErrorCodeInvalidContent,
+				RequestID: "req-3",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tc.message)); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			var reply errorReply
+			readWS(t, conn, CommandError, &reply)
+
+			if reply.Message == "" {
+				t.Fatal("expected error message to be set")
+			}
+
+			reply.Message = ""
+			if reply != tc.want {
+				t.Fatalf("unexpected error reply: %+v", reply)
+			}
+		})
+	}
+}
+
+func TestRequestIDEcho(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/6")
+	defer conn.Close()
+
+	requests := []struct {
+		id      string
+		command string
+		content interface{}
+	}{
+		{"req-1", CommandUpdateData, map[string]string{"data": "value"}},
+		{"req-2", CommandReadData, map[string]string{}},
+		{"req-3", CommandGetConnectionCount, map[string]string{}},
+		{"req-4", CommandWaitCheckpoint, map[string]interface{}{
+			"identifier": "echo", "target_count": 1,
+		}},
+	}
+
+	for _, req := range requests {
+		if err := writeWSWithID(conn, req.id, req.command, req.content); err != nil {
+			t.Fatalf("%s failed: %v", req.command, err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s response failed: %v", req.command, err)
+		}
+
+		var reply wsutil.Message
+		if err := json.Unmarshal(msg, &reply); err != nil {
+			t.Fatalf("failed to unmarshal %s reply: %v", req.command, err)
+		}
+		if reply.ID != req.id || reply.Command != req.command {
+			t.Fatalf("unexpected reply: id=%q command=%q", reply.ID, reply.Command)
+		}
+
+		if req.command != CommandReadData {
+			continue
+		}
+
+		var data runs.DataContent
+		if err := json.Unmarshal(reply.Content.Bytes, &data); err != nil {
+			t.Fatalf("failed to parse read_data envelope: %v", err)
+		}
+		if data.Encoding != runs.DataEncodingJSON || string(data.Data) != `{"data":"value"}` {
+			t.Fatalf("unexpected read_data envelope: %+v", data)
+		}
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/cas")
+	defer conn.Close()
+
+	if err := writeWSWithID(conn, "1", CommandUpdateData, map[string]int{"n": 1}); err != nil {
+		t.Fatalf("update_data failed: %v", err)
+	}
+
+	var ack struct {
+		Version int64 `json:"version"`
+	}
+	readWS(t, conn, CommandUpdateData, &ack)
+	if ack.Version != 1 {
+		t.Fatalf("unexpected update version: %d", ack.Version)
+	}
+
+	if err := writeWSWithID(conn, "2", CommandCompareAndSet, map[string]interface{}{
+		"expected_version": 1, "data": map[string]int{"n": 2},
+	}); err != nil {
+		t.Fatalf("compare_and_set failed: %v", err)
+	}
+
+	readWS(t, conn, CommandCompareAndSet, &ack)
+	if ack.Version != 2 {
+		t.Fatalf("unexpected compare_and_set version: %d", ack.Version)
+	}
+
+	if err := writeWSWithID(conn, "3", CommandCompareAndSet, map[string]interface{}{
+		"expected_version": 1, "data": map[string]int{"n": 3},
+	}); err != nil {
+		t.Fatalf("compare_and_set failed: %v", err)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	readWS(t, conn, CommandError, &errReply)
+	if errReply.Code != ErrorCodeVersionMismatch {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWSWithID(conn, "4", CommandReadData, map[string]string{}); err != nil {
+		t.Fatalf("read_data failed: %v", err)
+	}
+
+	var data runs.DataContent
+	readWS(t, conn, CommandReadData, &data)
+	if data.Version != 2 || string(data.Data) != `{"n":2}` {
+		t.Fatalf("unexpected read_data envelope: %+v", data)
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/keys")
+	defer conn.Close()
+
+	if err := writeWS(conn, CommandSetKey, map[string]interface{}{
+		"key": "room", "data": map[string]string{"url": "x"},
+	}); err != nil {
+		t.Fatalf("set_key failed: %v", err)
+	}
+
+	var set struct {
+		Key     string `json:"key"`
+		Version int64  `json:"version"`
+	}
+	readWS(t, conn, CommandSetKey, &set)
+	if set.Key != "room" || set.Version != 1 {
+		t.Fatalf("unexpected set_key reply: %+v", set)
+	}
+
+	if err := writeWS(conn, CommandSetKey, map[string]interface{}{
+		"key": "room", "data": 1, "expected_version": 0,
+	}); err != nil {
+		t.Fatalf("set_key failed: %v", err)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	readWS(t, conn, CommandError, &errReply)
+	if errReply.Code != ErrorCodeVersionMismatch {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(conn, CommandGetKey, map[string]string{"key": "room"}); err != nil {
+		t.Fatalf("get_key failed: %v", err)
+	}
+
+	var key runs.KeyContent
+	readWS(t, conn, CommandGetKey, &key)
+	if key.Key != "room" || key.Version != 1 || string(key.Data) != `{"url":"x"}` {
+		t.Fatalf("unexpected get_key reply: %+v", key)
+	}
+
+	if err := writeWS(conn, CommandListKeys, nil); err != nil {
+		t.Fatalf("list_keys failed: %v", err)
+	}
+
+	var list struct {
+		Keys []string `json:"keys"`
+	}
+	readWS(t, conn, CommandListKeys, &list)
+	if len(list.Keys) != 1 || list.Keys[0] != "room" {
+		t.Fatalf("unexpected list_keys reply: %+v", list)
+	}
+
+	if err := writeWS(conn, CommandDeleteKey, map[string]string{"key": "room"}); err != nil {
+		t.Fatalf("delete_key failed: %v", err)
+	}
+	readWS(t, conn, CommandDeleteKey, &key)
+
+	if err := writeWS(conn, CommandGetKey, map[string]string{"key": "room"}); err != nil {
+		t.Fatalf("get_key failed: %v", err)
+	}
+	readWS(t, conn, CommandError, &errReply)
+	if errReply.Code != ErrorCodeKeyNotFound {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+}
+
+func TestWatchData(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	watcher, _ := dialWS(t, httpServer.URL, "/register/watch")
+	defer watcher.Close()
+	writer, _ := dialWS(t, httpServer.URL, "/register/watch")
+	defer writer.Close()
+
+	if err := writeWSWithID(watcher, "w1", CommandWatchData, nil); err != nil {
+		t.Fatalf("watch_data failed: %v", err)
+	}
+
+	var current runs.KeyContent
+	readWS(t, watcher, CommandWatchData, &current)
+	if current.Key != runs.DefaultKey || current.Version != 0 {
+		t.Fatalf("unexpected watch_data reply: %+v", current)
+	}
+
+	if err := writeWS(writer, CommandUpdateData, map[string]int{"n": 1}); err != nil {
+		t.Fatalf("update_data failed: %v", err)
+	}
+
+	var change runs.DataChange
+	readWS(t, watcher, CommandDataChanged, &change)
+	if change.Version != 1 || string(change.Data) != `{"n":1}` {
+		t.Fatalf("unexpected data_changed: %+v", change)
+	}
+
+	if err := writeWS(watcher, CommandWatchData, map[string]string{"key": "k"}); err != nil {
+		t.Fatalf("watch_data failed: %v", err)
+	}
+	readWS(t, watcher, CommandWatchData, &current)
+
+	if err := writeWS(writer, CommandSetKey, map[string]interface{}{
+		"key": "k", "data": "v",
+	}); err != nil {
+		t.Fatalf("set_key failed: %v", err)
+	}
+
+	readWS(t, watcher, CommandDataChanged, &change)
+	if change.Key != "k" || change.Version != 1 || string(change.Data) != `"v"` {
+		t.Fatalf("unexpected data_changed: %+v", change)
+	}
+
+	if err := writeWS(watcher, CommandUnwatchData, nil); err != nil {
+		t.Fatalf("unwatch_data failed: %v", err)
+	}
+
+	var unwatch struct {
+		Removed bool `json:"removed"`
+	}
+	readWS(t, watcher, CommandUnwatchData, &unwatch)
+	if !unwatch.Removed {
+		t.Fatal("expected watch to be removed")
+	}
+
+	if err := writeWS(writer, CommandUpdateData, map[string]int{"n": 2}); err != nil {
+		t.Fatalf("update_data failed: %v", err)
+	}
+
+	if err := writeWS(writer, CommandDeleteKey, map[string]string{"key": "k"}); err != nil {
+		t.Fatalf("delete_key failed: %v", err)
+	}
+
+	// update of unwatched test data is skipped, next message is the deletion.
+	readWS(t, watcher, CommandDataChanged, &change)
+	if change.Key != "k" || !change.Deleted {
+		t.Fatalf("unexpected data_changed: %+v", change)
+	}
+}
+
+func TestCounterCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	const agents, increments = 4, 25
+
+	conns := make([]*websocket.Conn, agents)
+	for i := range conns {
+		conns[i], _ = dialWS(t, httpServer.URL, "/register/counters")
+		defer conns[i].Close()
+	}
+
+	// every agent increments concurrently, each value must be returned once.
+	for _, conn := range conns {
+		go func(conn *websocket.Conn) {
+			for i := 0; i < increments; i++ {
+				if err := writeWS(conn, CommandIncr, map[string]string{"name": "seq"}); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	seen := make(map[int64]bool)
+	for _, conn := range conns {
+		for i := 0; i < increments; i++ {
+			var reply runs.CounterValue
+			readWS(t, conn, CommandIncr, &reply)
+
+			if seen[reply.Value] || reply.Value < 1 || reply.Value > agents*increments {
+				t.Fatalf("unexpected counter value: %d", reply.Value)
+			}
+			seen[reply.Value] = true
+		}
+	}
+
+	if err := writeWS(conns[0], CommandDecr, map[string]interface{}{
+		"name": "seq", "by": 10,
+	}); err != nil {
+		t.Fatalf("decr failed: %v", err)
+	}
+
+	var reply runs.CounterValue
+	readWS(t, conns[0], CommandDecr, &reply)
+	if reply.Value != agents*increments-10 {
+		t.Fatalf("unexpected decr value: %d", reply.Value)
+	}
+
+	if err := writeWS(conns[0], CommandGetCounter, map[string]string{"name": "other"}); err != nil {
+		t.Fatalf("get_counter failed: %v", err)
+	}
+
+	readWS(t, conns[0], CommandGetCounter, &reply)
+	if reply.Name != "other" || reply.Value != 0 {
+		t.Fatalf("unexpected get_counter reply: %+v", reply)
+	}
+
+	if err := writeWS(conns[0], CommandDecr, map[string]interface{}{
+		"name": "seq", "by": -5,
+	}); err != nil {
+		t.Fatalf("decr failed: %v", err)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	readWS(t, conns[0], CommandError, &errReply)
+	if errReply.Code != ErrorCodeInvalidContent {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+}
+
+func TestLockCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	first, _ := dialWS(t, httpServer.URL, "/register/locks")
+	defer first.Close()
+	second, secondReg := dialWS(t, httpServer.URL, "/register/locks")
+	defer second.Close()
+	third, _ := dialWS(t, httpServer.URL, "/register/locks")
+	defer third.Close()
+
+	acquire := map[string]string{"name": "settings"}
+
+	var lock struct {
+		Name string `json:"name"`
+	}
+	var errReply struct {
+		Code string `json:"code"`
+	}
+
+	if err := writeWS(first, CommandLockAcquire, acquire); err != nil {
+		t.Fatalf("lock_acquire failed: %v", err)
+	}
+	readWS(t, first, CommandLockGranted, &lock)
+	if lock.Name != "settings" {
+		t.Fatalf("unexpected lock_granted: %+v", lock)
+	}
+
+	test, _ := runs.GetTest("locks")
+	l, _ := test.GetLock("settings")
+
+	for i, conn := range []*websocket.Conn{second, third} {
+		if err := writeWS(conn, CommandLockAcquire, acquire); err != nil {
+			t.Fatalf("lock_acquire failed: %v", err)
+		}
+
+		waitFor(t, func() bool { return len(l.Waiters()) == i+1 })
+	}
+
+	if err := writeWS(first, CommandLockAcquire, acquire); err != nil {
+		t.Fatalf("lock_acquire failed: %v", err)
+	}
+	readWS(t, first, CommandError, &errReply)
+	if errReply.Code != ErrorCodeLockConflict {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(first, CommandLockRelease, acquire); err != nil {
+		t.Fatalf("lock_release failed: %v", err)
+	}
+	readWS(t, first, CommandLockRelease, &lock)
+
+	// waiters are granted in FIFO order, disconnected holder keeps the lock
+	// while its session can be resumed.
+	readWS(t, second, CommandLockGranted, &lock)
+	second.Close()
+	waitFor(t, func() bool { return test.ConnectionCount() == 2 })
+	if l.Holder() != secondReg.AgentID {
+		t.Fatalf("expected lock to be kept by %q, held by %q", secondReg.AgentID, l.Holder())
+	}
+
+	resumed, _ := dialWS(
+		t, httpServer.URL,
+		"/register/locks?agent_id="+secondReg.AgentID+"&resume_token="+secondReg.ResumeToken,
+	)
+	defer resumed.Close()
+
+	if err := writeWS(resumed, CommandLockRelease, acquire); err != nil {
+		t.Fatalf("lock_release failed: %v", err)
+	}
+	readWS(t, resumed, CommandLockRelease, &lock)
+	readWS(t, third, CommandLockGranted, &lock)
+
+	if err := writeWS(third, CommandLockRelease, acquire); err != nil {
+		t.Fatalf("lock_release failed: %v", err)
+	}
+	readWS(t, third, CommandLockRelease, &lock)
+	if l.Holder() != "" {
+		t.Fatalf("expected free lock, held by %q", l.Holder())
+	}
+
+	if err := writeWS(third, CommandLockAcquire, map[string]interface{}{
+		"name": "settings", "ttl_ms": 50,
+	}); err != nil {
+		t.Fatalf("lock_acquire failed: %v", err)
+	}
+	readWS(t, third, CommandLockGranted, &lock)
+	readWS(t, third, CommandLockExpired, &lock)
+
+	if err := writeWS(third, CommandLockRelease, acquire); err != nil {
+		t.Fatalf("lock_release failed: %v", err)
+	}
+	readWS(t, third, CommandError, &errReply)
+	if errReply.Code != ErrorCodeLockNotHeld {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+}
+
+func TestSemaphoreCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+	setResumeGracePeriod(t, 0)
+
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conns[i], _ = dialWS(t, httpServer.URL, "/register/sem")
+		defer conns[i].Close()
+	}
+
+	acquire := map[string]interface{}{"name": "checkout", "permits": 2}
+
+	var sem struct {
+		Name string `json:"name"`
+	}
+	var errReply struct {
+		Code string `json:"code"`
+	}
+
+	for _, conn := range conns[:2] {
+		if err := writeWS(conn, CommandSemAcquire, acquire); err != nil {
+			t.Fatalf("sem_acquire failed: %v", err)
+		}
+		readWS(t, conn, CommandSemGranted, &sem)
+	}
+
+	if err := writeWS(conns[2], CommandSemAcquire, acquire); err != nil {
+		t.Fatalf("sem_acquire failed: %v", err)
+	}
+
+	test, _ := runs.GetTest("sem")
+	s, _ := test.GetSemaphore("checkout")
+	waitFor(t, func() bool { return s.Waiters() == 1 })
+
+	// removal of disconnected agent returns the permit to the waiting agent.
+	conns[1].Close()
+	readWS(t, conns[2], CommandSemGranted, &sem)
+	if sem.Name != "checkout" || s.Holders() != 2 {
+		t.Fatalf("unexpected sem_granted: %+v, holders %d", sem, s.Holders())
+	}
+
+	if err := writeWS(conns[0], CommandSemRelease, acquire); err != nil {
+		t.Fatalf("sem_release failed: %v", err)
+	}
+	readWS(t, conns[0], CommandSemRelease, &sem)
+
+	if err := writeWS(conns[0], CommandSemRelease, acquire); err != nil {
+		t.Fatalf("sem_release failed: %v", err)
+	}
+	readWS(t, conns[0], CommandError, &errReply)
+	if errReply.Code != ErrorCodeSemaphoreNotHeld {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	mismatch := map[string]interface{}{"name": "checkout", "permits": 3}
+	if err := writeWS(conns[0], CommandSemAcquire, mismatch); err != nil {
+		t.Fatalf("sem_acquire failed: %v", err)
+	}
+	readWS(t, conns[0], CommandError, &errReply)
+	if errReply.Code != ErrorCodeSemaphorePermits {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(conns[0], CommandSemAcquire, map[string]string{"name": "zero"}); err != nil {
+		t.Fatalf("sem_acquire failed: %v", err)
+	}
+	readWS(t, conns[0], CommandError, &errReply)
+	if errReply.Code != ErrorCodeInvalidContent {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+}
+
+func TestElectLeader(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conns := make([]*websocket.Conn, 3)
+	ids := make([]string, 3)
+	for i := range conns {
+		var reg registration
+		conns[i], reg = dialWS(t, httpServer.URL, "/register/election")
+		defer conns[i].Close()
+
+		ids[i] = reg.AgentID
+	}
+
+	for i, conn := range conns {
+		if err := writeWS(conn, CommandElectLeader, map[string]string{"name": "setup"}); err != nil {
+			t.Fatalf("elect_leader failed: %v", err)
+		}
+
+		var status runs.ElectionStatus
+		readWS(t, conn, CommandElectLeader, &status)
+		if status.LeaderID != ids[0] || status.IsLeader != (i == 0) {
+			t.Fatalf("unexpected elect_leader reply for agent %d: %+v", i, status)
+		}
+	}
+
+	// leader drops, the next participant takes over.
+	conns[0].Close()
+
+	for i, conn := range conns[1:] {
+		var status runs.ElectionStatus
+		readWS(t, conn, CommandLeaderChanged, &status)
+		if status.Name != "setup" || status.LeaderID != ids[1] || status.IsLeader != (i == 0) {
+			t.Fatalf("unexpected leader_changed for agent %d: %+v", i+1, status)
+		}
+	}
+
+	// non-leader leaving does not trigger re-election.
+	conns[2].Close()
+
+	test, _ := runs.GetTest("election")
+	waitFor(t, func() bool { return test.ConnectionCount() == 1 })
+
+	e, _ := test.GetElection("setup")
+	if e.Leader() != ids[1] {
+		t.Fatalf("unexpected leader: %q", e.Leader())
+	}
+}
+
+func TestRoles(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	test := runs.EnsureTest("roles", func() *runs.Test { return &runs.Test{} })
+	if err := test.SetRoles([]runs.RoleDefinition{
+		{Name: "presenter", Count: 1},
+		{Name: "viewer"},
+	}); err != nil {
+		t.Fatalf("set roles failed: %v", err)
+	}
+
+	presenter, reg := dialWS(t, httpServer.URL, "/register/roles?role=presenter")
+	defer presenter.Close()
+	if reg.Role == nil || *reg.Role != (runs.RoleAssignment{Role: "presenter"}) {
+		t.Fatalf("unexpected registration role: %+v", reg.Role)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") +
+		"/register/roles?role=presenter"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected full role to be rejected, got %+v", resp)
+	}
+
+	viewer, reg := dialWS(t, httpServer.URL, "/register/roles")
+	defer viewer.Close()
+	if reg.Role != nil {
+		t.Fatalf("unexpected registration role: %+v", reg.Role)
+	}
+
+	if err := writeWS(viewer, CommandClaimRole, map[string]string{"role": "presenter"}); err != nil {
+		t.Fatalf("claim_role failed: %v", err)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	readWS(t, viewer, CommandError, &errReply)
+	if errReply.Code != ErrorCodeRoleFull {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(viewer, CommandClaimRole, nil); err != nil {
+		t.Fatalf("claim_role failed: %v", err)
+	}
+
+	var assignment runs.RoleAssignment
+	readWS(t, viewer, CommandClaimRole, &assignment)
+	if assignment != (runs.RoleAssignment{Role: "viewer"}) {
+		t.Fatalf("unexpected claim_role reply: %+v", assignment)
+	}
+}
+
+func TestPoolCommands(t *testing.T) {
+	httpServer, service := newTestServer(t)
+	setResumeGracePeriod(t, 0)
+
+	err := service.SavePool("pool", "accounts", [][]byte{[]byte(`"alice"`)})
+	if err != nil {
+		t.Fatalf("save pool failed: %v", err)
+	}
+
+	err = service.SavePool(runs.GlobalPool, "rooms", [][]byte{[]byte(`{"room":1}`)})
+	if err != nil {
+		t.Fatalf("save global pool failed: %v", err)
+	}
+
+	first, _ := dialWS(t, httpServer.URL, "/register/pool")
+	defer first.Close()
+	second, _ := dialWS(t, httpServer.URL, "/register/pool")
+	defer second.Close()
+
+	lease := map[string]interface{}{"pool": "accounts"}
+
+	var leased runs.PoolLease
+	var errReply struct {
+		Code string `json:"code"`
+	}
+
+	if err := writeWS(first, CommandLeaseItem, lease); err != nil {
+		t.Fatalf("lease_item failed: %v", err)
+	}
+	readWS(t, first, CommandLeaseItem, &leased)
+	if leased.Pool != "accounts" || leased.ItemID != 1 ||
+		string(leased.Item) != `"alice"` || leased.LeaseID == "" {
+		t.Fatalf("unexpected lease_item reply: %+v", leased)
+	}
+
+	if err := writeWS(second, CommandLeaseItem, lease); err != nil {
+		t.Fatalf("lease_item failed: %v", err)
+	}
+	readWS(t, second, CommandError, &errReply)
+	if errReply.Code != ErrorCodePoolExhausted {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	// removal of disconnected agent returns the leased item.
+	first.Close()
+	waitFor(t, func() bool {
+		status, err := service.ReadPool("pool", "accounts")
+		return err == nil && status.Free == 1
+	})
+
+	if err := writeWS(second, CommandLeaseItem, lease); err != nil {
+		t.Fatalf("lease_item failed: %v", err)
+	}
+	readWS(t, second, CommandLeaseItem, &leased)
+
+	returnReq := map[string]interface{}{"pool": "accounts", "lease_id": leased.LeaseID}
+	for _, command := range []string{CommandReturnItem, CommandError} {
+		if err := writeWS(second, CommandReturnItem, returnReq); err != nil {
+			t.Fatalf("return_item failed: %v", err)
+		}
+		readWS(t, second, command, &errReply)
+	}
+	if errReply.Code != ErrorCodeLeaseNotFound {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWSWithID(second, "room", CommandLeaseItem, map[string]interface{}{
+		"pool": "rooms", "global": true, "ttl_ms": 50,
+	}); err != nil {
+		t.Fatalf("lease_item failed: %v", err)
+	}
+	readWS(t, second, CommandLeaseItem, &leased)
+	if !leased.Global || string(leased.Item) != `{"room":1}` || leased.ExpiresAt == 0 {
+		t.Fatalf("unexpected global lease: %+v", leased)
+	}
+
+	var expired runs.PoolLease
+	readWS(t, second, CommandLeaseExpired, &expired)
+	if expired.LeaseID != leased.LeaseID || expired.Pool != "rooms" {
+		t.Fatalf("unexpected lease_expired: %+v", expired)
+	}
+
+	if err := writeWS(second, CommandLeaseItem, map[string]string{"pool": "missing"}); err != nil {
+		t.Fatalf("lease_item failed: %v", err)
+	}
+	readWS(t, second, CommandError, &errReply)
+	if errReply.Code != ErrorCodePoolNotFound {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+}
+
+func TestNextRow(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/feed")
+	defer conn.Close()
+	other, _ := dialWS(t, httpServer.URL, "/register/feed")
+	defer other.Close()
+
+	test, _ := runs.GetTest("feed")
+	test.SetFeed(runs.NewFeed("users", runs.FeedSequential, []json.RawMessage{
+		[]byte(`{"user":"alice"}`),
+		[]byte(`{"user":"bob"}`),
+	}))
+
+	var row runs.FeedRow
+	var errReply struct {
+		Code string `json:"code"`
+	}
+
+	// agents share the feed, every row is received once.
+	for i, agent := range []*websocket.Conn{conn, other} {
+		if err := writeWS(agent, CommandNextRow, map[string]string{"feed": "users"}); err != nil {
+			t.Fatalf("next_row failed: %v", err)
+		}
+		readWS(t, agent, CommandNextRow, &row)
+		if row.Feed != "users" || row.Index != i {
+			t.Fatalf("unexpected next_row reply: %+v", row)
+		}
+	}
+	if string(row.Row) != `{"user":"bob"}` {
+		t.Fatalf("unexpected row: %s", row.Row)
+	}
+
+	for feed, code := range map[string]string{
+		"users":   ErrorCodeFeedExhausted,
+		"missing": ErrorCodeFeedNotFound,
+	} {
+		if err := writeWS(conn, CommandNextRow, map[string]string{"feed": feed}); err != nil {
+			t.Fatalf("next_row failed: %v", err)
+		}
+		readWS(t, conn, CommandError, &errReply)
+		if errReply.Code != code {
+			t.Fatalf("unexpected error code for %q: %q", feed, errReply.Code)
+		}
+	}
+}
+
+func TestQueueCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+	setResumeGracePeriod(t, 0)
+
+	consumer, _ := dialWS(t, httpServer.URL, "/register/queue")
+	defer consumer.Close()
+	producer, _ := dialWS(t, httpServer.URL, "/register/queue")
+	defer producer.Close()
+
+	var task runs.QueueTask
+	var errReply struct {
+		Code string `json:"code"`
+	}
+
+	if err := writeWS(consumer, CommandQueuePop, map[string]string{"queue": "steps"}); err != nil {
+		t.Fatalf("queue_pop failed: %v", err)
+	}
+
+	test, _ := runs.GetTest("queue")
+	waitFor(t, func() bool {
+		q, ok := test.GetQueue("steps")
+		return ok && q.Status().Waiting == 1
+	})
+
+	if err := writeWS(producer, CommandQueuePush, map[string]string{"queue": "steps"}); err != nil {
+		t.Fatalf("queue_push failed: %v", err)
+	}
+	readWS(t, producer, CommandError, &errReply)
+	if errReply.Code != ErrorCodeInvalidContent {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(producer, CommandQueuePush, map[string]interface{}{
+		"queue": "steps", "data": map[string]int{"step": 1},
+	}); err != nil {
+		t.Fatalf("queue_push failed: %v", err)
+	}
+	readWS(t, producer, CommandQueuePush, &task)
+	if task.Queue != "steps" || task.TaskID != 1 {
+		t.Fatalf("unexpected queue_push reply: %+v", task)
+	}
+
+	readWS(t, consumer, CommandQueuePop, &task)
+	if task.TaskID != 1 || string(task.Data) != `{"step":1}` {
+		t.Fatalf("unexpected queue_pop reply: %+v", task)
+	}
+
+	// task that is not acknowledged is queued again once the disconnected
+	// agent is removed.
+	consumer.Close()
+	q, _ := test.GetQueue("steps")
+	waitFor(t, func() bool { return q.Status().Pending == 1 })
+
+	if err := writeWS(producer, CommandQueuePop, map[string]string{"queue": "steps"}); err != nil {
+		t.Fatalf("queue_pop failed: %v", err)
+	}
+	readWS(t, producer, CommandQueuePop, &task)
+	if task.TaskID != 1 || string(task.Data) != `{"step":1}` {
+		t.Fatalf("unexpected queue_pop reply: %+v", task)
+	}
+
+	ack := map[string]interface{}{"queue": "steps", "task_id": 1}
+	for _, command := range []string{CommandQueueAck, CommandError} {
+		if err := writeWS(producer, CommandQueueAck, ack); err != nil {
+			t.Fatalf("queue_ack failed: %v", err)
+		}
+		readWS(t, producer, command, &errReply)
+	}
+	if errReply.Code != ErrorCodeTaskNotFound {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
+
+	if err := writeWS(producer, CommandQueuePop, map[string]interface{}{
+		"queue": "steps", "timeout_ms": 50,
+	}); err != nil {
+		t.Fatalf("queue_pop failed: %v", err)
+	}
+	task = runs.QueueTask{}
+	readWS(t, producer, CommandQueuePop, &task)
+	if !task.TimedOut || task.Queue != "steps" {
+		t.Fatalf("expected timed out queue_pop, got %+v", task)
+	}
+
+	if status := q.Status(); status != (runs.QueueStatus{Name: "steps"}) {
+		t.Fatalf("expected empty queue, got %+v", status)
+	}
+}
+
+func TestChannelCommands(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	subscriber, _ := dialWS(t, httpServer.URL, "/register/channel")
+	defer subscriber.Close()
+	publisher, pubReg := dialWS(t, httpServer.URL, "/register/channel")
+	defer publisher.Close()
+
+	var subscribed struct {
+		Channel string                `json:"channel"`
+		History []runs.ChannelMessage `json:"history"`
+	}
+	var published struct {
+		Seq         int64 `json:"seq"`
+		Subscribers int   `json:"subscribers"`
+	}
+
+	if err := writeWSWithID(subscriber, "sub", CommandSubscribe, map[string]interface{}{
+		"channel": "chat", "history": 2,
+	}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	readWS(t, subscriber, CommandSubscribe, &subscribed)
+	if subscribed.Channel != "chat" || len(subscribed.History) != 0 {
+		t.Fatalf("unexpected subscribe reply: %+v", subscribed)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		if err := writeWS(publisher, CommandPublish, map[string]interface{}{
+			"channel": "chat", "data": i,
+		}); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+		readWS(t, publisher, CommandPublish, &published)
+		if published.Seq != i || published.Subscribers != 1 {
+			t.Fatalf("unexpected publish reply: %+v", published)
+		}
+
+		var msg runs.ChannelMessage
+		readWS(t, subscriber, CommandChannelMessage, &msg)
+		if msg.Seq != i || msg.SenderID != pubReg.AgentID || string(msg.Data) != fmt.Sprint(i) {
+			t.Fatalf("unexpected channel message: %+v", msg)
+		}
+	}
+
+	// late subscriber replays the last messages kept in history.
+	if err := writeWS(publisher, CommandSubscribe, map[string]string{"channel": "chat"}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	readWS(t, publisher, CommandSubscribe, &subscribed)
+	if len(subscribed.History) != 2 || subscribed.History[0].Seq != 2 ||
+		subscribed.History[1].Seq != 3 {
+		t.Fatalf("unexpected history: %+v", subscribed.History)
+	}
+
+	var unsubscribed struct {
+		Removed bool `json:"removed"`
+	}
+	if err := writeWS(subscriber, CommandUnsubscribe, map[string]string{"channel": "chat"}); err != nil {
+		t.Fatalf("unsubscribe failed: %v", err)
+	}
+	readWS(t, subscriber, CommandUnsubscribe, &unsubscribed)
+	if !unsubscribed.Removed {
+		t.Fatal("expected subscription to be removed")
+	}
+
+	if err := writeWS(subscriber, CommandPublish, map[string]string{"channel": "chat"}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	readWS(t, subscriber, CommandPublish, &published)
+	if published.Subscribers != 1 {
+		t.Fatalf("unexpected publish reply: %+v", published)
+	}
+
+	var msg runs.ChannelMessage
+	readWS(t, publisher, CommandChannelMessage, &msg)
+	if msg.Seq != 4 || string(msg.Data) != "null" {
+		t.Fatalf("unexpected channel message: %+v", msg)
+	}
+}
+
+func TestSendTo(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	test := runs.EnsureTest("direct", func() *runs.Test { return &runs.Test{} })
+	if err := test.SetRoles([]runs.RoleDefinition{
+		{Name: "presenter", Count: 1},
+		{Name: "viewer"},
+	}); err != nil {
+		t.Fatalf("set roles failed: %v", err)
+	}
+
+	presenter, presenterReg := dialWS(t, httpServer.URL, "/register/direct?role=presenter")
+	defer presenter.Close()
+
+	viewers := make([]*websocket.Conn, 2)
+	viewerIDs := make([]string, 2)
+	for i := range viewers {
+		var reg registration
+		viewers[i], reg = dialWS(t, httpServer.URL, "/register/direct?role=viewer")
+		defer viewers[i].Close()
+		viewerIDs[i] = reg.AgentID
+	}
+
+	var sent struct {
+		Delivered []string `json:"delivered"`
+	}
+	var msg runs.DirectMessage
+
+	if err := writeWS(presenter, CommandSendTo, map[string]interface{}{
+		"role": "viewer", "data": "slide-2",
+	}); err != nil {
+		t.Fatalf("send_to failed: %v", err)
+	}
+	readWS(t, presenter, CommandSendTo, &sent)
+	if len(sent.Delivered) != 2 {
+		t.Fatalf("unexpected send_to reply: %+v", sent)
+	}
+
+	for _, viewer := range viewers {
+		readWS(t, viewer, CommandMessage, &msg)
+		if msg.SenderID != presenterReg.AgentID || msg.SenderRole == nil ||
+			msg.SenderRole.Role != "presenter" || string(msg.Data) != `"slide-2"` {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	}
+
+	if err := writeWS(presenter, CommandSendTo, map[string]interface{}{
+		"role": "viewer", "ordinal": 1, "data": 1,
+	}); err != nil {
+		t.Fatalf("send_to failed: %v", err)
+	}
+	readWS(t, presenter, CommandSendTo, &sent)
+	readWS(t, viewers[1], CommandMessage, &msg)
+	if len(sent.Delivered) != 1 || sent.Delivered[0] != viewerIDs[1] ||
+		string(msg.Data) != "1" {
+		t.Fatalf("unexpected message: %+v, reply %+v", msg, sent)
+	}
+
+	if err := writeWS(viewers[0], CommandSendTo, map[string]interface{}{
+		"agent_id": presenterReg.AgentID, "data": "ready",
+	}); err != nil {
+		t.Fatalf("send_to failed: %v", err)
+	}
+	readWS(t, viewers[0], CommandSendTo, &sent)
+	readWS(t, presenter, CommandMessage, &msg)
+	if msg.SenderRole == nil || *msg.SenderRole != (runs.RoleAssignment{Role: "viewer"}) {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	for content, code := range map[string]string{
+		`{"agent_id":"missing"}`:             ErrorCodeAgentNotConnected,
+		`{"role":"host"}`:                    ErrorCodeAgentNotConnected,
+		`{}`:                                 ErrorCodeInvalidContent,
+		`{"agent_id":"missing","ordinal":0}`: ErrorCodeInvalidContent,
+	} {
+		if err := writeWS(presenter, CommandSendTo, json.RawMessage(content)); err != nil {
+			t.Fatalf("send_to failed: %v", err)
+		}
+		readWS(t, presenter, CommandError, &errReply)
+		if errReply.Code != code {
+			t.Fatalf("unexpected error code for %s: %q", content, errReply.Code)
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	sender, senderReg := dialWS(t, httpServer.URL, "/register/broadcast")
+	defer sender.Close()
+	receiver, _ := dialWS(t, httpServer.URL, "/register/broadcast")
+	defer receiver.Close()
+
+	var reply struct {
+		Recipients int `json:"recipients"`
+	}
+	var msg runs.BroadcastMessage
+
+	if err := writeWS(sender, CommandBroadcast, map[string]interface{}{
+		"data": "go",
+	}); err != nil {
+		t.Fatalf("broadcast failed: %v", err)
+	}
+	readWS(t, sender, CommandBroadcastMessage, &msg)
+	readWS(t, sender, CommandBroadcast, &reply)
+	if reply.Recipients != 2 {
+		t.Fatalf("unexpected broadcast reply: %+v", reply)
+	}
+
+	readWS(t, receiver, CommandBroadcastMessage, &msg)
+	if msg.SenderID != senderReg.AgentID || string(msg.Data) != `"go"` {
+		t.Fatalf("unexpected broadcast message: %+v", msg)
+	}
+
+	if err := writeWS(sender, CommandBroadcast, map[string]interface{}{
+		"data": "stop", "exclude_sender": true,
+	}); err != nil {
+		t.Fatalf("broadcast failed: %v", err)
+	}
+	readWS(t, sender, CommandBroadcast, &reply)
+	if reply.Recipients != 1 {
+		t.Fatalf("unexpected broadcast reply: %+v", reply)
+	}
+
+	readWS(t, receiver, CommandBroadcastMessage, &msg)
+	if string(msg.Data) != `"stop"` {
+		t.Fatalf("unexpected broadcast message: %+v", msg)
+	}
+
+	// messages broadcast over HTTP carry no sender.
+	test, _ := runs.GetTest("broadcast")
+	if recipients := test.Broadcast(runs.BroadcastMessage{
+		Data: json.RawMessage(`"end"`),
+	}, true); recipients != 2 {
+		t.Fatalf("expected 2 recipients, got %d", recipients)
+	}
+
+	msg = runs.BroadcastMessage{}
+	readWS(t, receiver, CommandBroadcastMessage, &msg)
+	if msg.SenderID != "" || string(msg.Data) != `"end"` {
+		t.Fatalf("unexpected broadcast message: %+v", msg)
+	}
+}
+
+func TestDeleteTestClosesConnections(t *testing.T) {
+	httpServer, service := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/7")
+	defer conn.Close()
+
+	if err := writeWS(conn, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "deleted",
+		"target_count": 2,
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+
+	test, _ := runs.GetTest("7")
+	waitFor(t, func() bool {
+		_, ok := test.GetCheckpoint("deleted")
+		return ok
+	})
+
+	if err := service.DeleteTest("7"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected normal close frame, got %v", err)
+	}
+
+	if _, ok := runs.GetTest("7"); ok {
+		t.Fatal("expected test to be removed")
+	}
+	if _, ok := test.GetCheckpoint("deleted"); ok {
+		t.Fatal("expected checkpoints to be dropped")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setResumeGracePeriod overrides resume grace period for the duration of the
+// test, zero removes disconnected agents right away.
+func setResumeGracePeriod(t *testing.T, grace time.Duration) {
+	t.Helper()
+
+	original := ResumeGracePeriod
+	ResumeGracePeriod = grace
+	t.Cleanup(func() { ResumeGracePeriod = original })
+}
+
+func writeWS(conn *websocket.Conn, command string, content interface{}) error {
+	return writeWSWithID(conn, "", command, content)
+}
+
+func writeWSWithID(conn *websocket.Conn, id, command string, content interface{}) error {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(wsutil.Message{ID: id, Command: command, Content: wsutil.RawMessage{Bytes: body}})
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(websocket.TextMessage, message)
+}
+
+func TestWaitCheckpointTimeout(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, reg := dialWS(t, httpServer.URL, "/register/2")
+	defer conn.Close()
+
+	if err := writeWS(conn, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "checkpoint-timeout",
+		"target_count": 2,
+		"timeout_ms":   50,
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("wait_checkpoint response failed: %v", err)
+	}
+
+	var cpMsg wsutil.Message
+	if err := json.Unmarshal(msg, &cpMsg); err != nil {
+		t.Fatalf("failed to unmarshal checkpoint msg: %v", err)
+	}
+
+	var status struct {
+		Finished     bool     `json:"finished"`
+		Reason       string   `json:"reason"`
+		Participants []string `json:"participants"`
+	}
+	if err := json.Unmarshal(cpMsg.Content.Bytes, &status); err != nil {
+		t.Fatalf("failed to parse checkpoint payload: %v", err)
+	}
+	if status.Finished || status.Reason != "timeout" {
+		t.Fatalf("unexpected checkpoint status: %+v", status)
+	}
+	if len(status.Participants) != 1 || status.Participants[0] != reg.AgentID {
+		t.Fatalf("unexpected participants: %v", status.Participants)
+	}
+}
+
+func TestWaitCheckpointPayloads(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	first, firstReg := dialWS(t, httpServer.URL, "/register/payloads")
+	defer first.Close()
+	second, secondReg := dialWS(t, httpServer.URL, "/register/payloads")
+	defer second.Close()
+
+	if err := writeWS(first, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "links",
+		"target_count": 2,
+		"payload":      map[string]string{"link": "https://meet/1"},
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+	if err := writeWS(second, CommandWaitCheckpoint, map[string]interface{}{
+		"identifier":   "links",
+		"target_count": 2,
+	}); err != nil {
+		t.Fatalf("wait_checkpoint failed: %v", err)
+	}
+
+	for _, conn := range []*websocket.Conn{first, second} {
+		var status struct {
+			Finished bool                       `json:"finished"`
+			Payloads map[string]json.RawMessage `json:"payloads"`
+		}
+		readWS(t, conn, CommandWaitCheckpoint, &status)
+
+		if !status.Finished || len(status.Payloads) != 2 ||
+			string(status.Payloads[firstReg.AgentID]) != `{"link":"https://meet/1"}` ||
+			string(status.Payloads[secondReg.AgentID]) != "null" {
+			t.Fatalf("unexpected checkpoint status: %+v", status)
+		}
+	}
+}
+
+func TestTimeSync(t *testing.T) {
+	httpServer, _ := newTestServer(t)
+
+	conn, _ := dialWS(t, httpServer.URL, "/register/clock")
+	defer conn.Close()
+
+	sent := time.Now().UnixMicro()
+	err := writeWS(conn, CommandTimeSync, wsutil.TimeSync{ClientSend: sent})
+	if err != nil {
+		t.Fatalf("time_sync failed: %v", err)
+	}
+
+	var reply wsutil.TimeSync
+	readWS(t, conn, CommandTimeSync, &reply)
+	if reply.ClientSend != sent || reply.ServerReceive < sent ||
+		reply.ServerSend < reply.ServerReceive {
+		t.Fatalf("unexpected time_sync reply: %+v", reply)
+	}
+
+	// server and test share the clock, so offset is bound by the round trip
+	// and microsecond precision of server timestamps.
+	offset, err := wsutil.SyncClock(conn, 5)
+	if err != nil {
+		t.Fatalf("sync clock failed: %v", err)
+	}
+
+	limit := offset.RoundTrip + 2*time.Microsecond
+	if offset.Offset > limit || offset.Offset < -limit {
+		t.Fatalf("unexpected clock offset: %+v", offset)
+	}
+
+	startAt := time.Now().Add(time.Second).UnixMilli()
+	local := offset.LocalTime(startAt)
+	if local.Sub(time.UnixMilli(startAt)) != -offset.Offset {
+		t.Fatalf("unexpected local start time: %s", local)
+	}
+
+	var errReply struct {
+		Code string `json:"code"`
+	}
+	err = writeWS(conn, CommandTimeSync, json.RawMessage(`{"client_send":"now"}`))
+	if err != nil {
+		t.Fatalf("time_sync failed: %v", err)
+	}
+	readWS(t, conn, CommandError, &errReply)
+	if errReply.Code != ErrorCodeInvalidContent {
+		t.Fatalf("unexpected error code: %q", errReply.Code)
+	}
 }
@@ -30,6 +30,16 @@ func StartWebSocketServer(port int) *Server {
 	return s
 }
 
+// commandHandler returns server handler, one using runs.DefaultService if it's
+// not set.
+func (s *Server) commandHandler() *CommandHandler {
+	if s.Handler == nil {
+		return NewCommandHandler(nil)
+	}
+
+	return s.Handler
+}
+
 // Shutdown gracefully stops the WebSocket server.
 func (s *Server) Shutdown(ctx context.Context) error {
 	if s == nil || s.HTTPServer == nil {
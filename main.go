@@ -109,6 +109,12 @@ func main() {
 
 	runs.SyncClient = conf.SyncClient
 	ws.SyncClient = conf.SyncClient
+	ws.ResumeGracePeriod = time.Duration(
+		conf.WebSocket.ResumeGracePeriodMS,
+	) * time.Millisecond
+	runs.DefaultStartDelay = time.Duration(
+		*conf.Checkpoint.StartDelayMS,
+	) * time.Millisecond
 
 	handler, err := api.HandleRoutes()
 	if err != nil {
@@ -1,75 +1,379 @@
 package storage
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
 
 type memoryRecord struct {
 	data    []byte
+	version int64
+	created int64
+}
+
+type memoryCounter struct {
+	value   int64
+	created int64
+}
+
+type memoryPool struct {
+	items   []PoolItem
 	created int64
 }
 
 // MemoryStore keeps test data in memory.
 type MemoryStore struct {
-	mu   sync.RWMutex
-	data map[int]memoryRecord
+	mu sync.RWMutex
+	// data holds records by test ID and key, test data is kept as DefaultKey.
+	data     map[string]map[string]memoryRecord
+	counters map[string]map[string]memoryCounter
+	pools    map[string]map[string]*memoryPool
 }
 
 // NewMemoryStore creates an in-memory data store.
 func NewMemoryStore() DataStore {
-	return &MemoryStore{data: make(map[int]memoryRecord)}
+	return &MemoryStore{
+		data:     make(map[string]map[string]memoryRecord),
+		counters: make(map[string]map[string]memoryCounter),
+		pools:    make(map[string]map[string]*memoryPool),
+	}
 }
 
-func (m *MemoryStore) SaveData(testID int, data []byte) error {
+func (m *MemoryStore) SaveData(testID string, data []byte) error {
+	_, err := m.CompareAndSave(testID, data, AnyVersion)
+	return err
+}
+
+func (m *MemoryStore) LoadData(testID string) ([]byte, bool, error) {
+	data, _, ok, err := m.LoadDataVersion(testID)
+	return data, ok, err
+}
+
+func (m *MemoryStore) LoadDataVersion(testID string) ([]byte, int64, bool, error) {
+	return m.LoadKey(testID, DefaultKey)
+}
+
+func (m *MemoryStore) CompareAndSave(
+	testID string, data []byte, expected int64,
+) (int64, error) {
+	return m.CompareAndSaveKey(testID, DefaultKey, data, expected)
+}
+
+func (m *MemoryStore) DeleteData(testID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	copyData := make([]byte, len(data))
-	copy(copyData, data)
-
-	m.data[testID] = memoryRecord{data: copyData, created: time.Now().UnixMilli()}
+	delete(m.data, testID)
+	delete(m.counters, testID)
+	delete(m.pools, testID)
+	m.returnPoolItems(testID, "")
 	return nil
 }
 
-func (m *MemoryStore) LoadData(testID int) ([]byte, bool, error) {
+func (m *MemoryStore) TestExists(testID string) (bool, error) {
 	m.mu.RLock()
-	rec, ok := m.data[testID]
+	defer m.mu.RUnlock()
+
+	exists := len(m.data[testID]) > 0 || len(m.counters[testID]) > 0 ||
+		len(m.pools[testID]) > 0
+
+	return exists, nil
+}
+
+func (m *MemoryStore) LoadKey(testID, key string) ([]byte, int64, bool, error) {
+	m.mu.RLock()
+	rec, ok := m.data[testID][key]
 	m.mu.RUnlock()
 
 	if !ok {
-		return nil, false, nil
+		return nil, 0, false, nil
 	}
 
 	copyData := make([]byte, len(rec.data))
 	copy(copyData, rec.data)
 
-	return copyData, true, nil
+	return copyData, rec.version, true, nil
 }
 
-func (m *MemoryStore) DeleteData(testID int) error {
+func (m *MemoryStore) CompareAndSaveKey(
+	testID, key string, data []byte, expected int64,
+) (int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.data, testID)
+	records, ok := m.data[testID]
+	if !ok {
+		records = make(map[string]memoryRecord)
+		m.data[testID] = records
+	}
+
+	current := records[key].version
+	if expected != AnyVersion && expected != current {
+		return 0, ErrVersionMismatch
+	}
+
+	copyData := make([]byte, len(data))
+	copy(copyData, data)
+
+	records[key] = memoryRecord{
+		data:    copyData,
+		version: current + 1,
+		created: time.Now().UnixMilli(),
+	}
+
+	return current + 1, nil
+}
+
+func (m *MemoryStore) DeleteKey(testID, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := m.data[testID]
+	if _, ok := records[key]; !ok {
+		return false, nil
+	}
+
+	delete(records, key)
+	if len(records) == 0 {
+		delete(m.data, testID)
+	}
+
+	return true, nil
+}
+
+func (m *MemoryStore) ListKeys(testID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.data[testID]))
+	for key := range m.data[testID] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (m *MemoryStore) AddCounter(testID, name string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters, ok := m.counters[testID]
+	if !ok {
+		counters = make(map[string]memoryCounter)
+		m.counters[testID] = counters
+	}
+
+	value := counters[name].value + delta
+	counters[name] = memoryCounter{value: value, created: time.Now().UnixMilli()}
+
+	return value, nil
+}
+
+func (m *MemoryStore) LoadCounter(testID, name string) (int64, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counter, ok := m.counters[testID][name]
+
+	return counter.value, ok, nil
+}
+
+func (m *MemoryStore) SavePool(testID, pool string, items [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pools, ok := m.pools[testID]
+	if !ok {
+		pools = make(map[string]*memoryPool)
+		m.pools[testID] = pools
+	}
+
+	stored := make([]PoolItem, len(items))
+	for i, item := range items {
+		stored[i] = PoolItem{ID: int64(i + 1), Data: copyBytes(item)}
+	}
+
+	pools[pool] = &memoryPool{items: stored, created: time.Now().UnixMilli()}
+
 	return nil
 }
 
+func (m *MemoryStore) LoadPool(testID, pool string) ([]PoolItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.pools[testID][pool]
+	if !ok {
+		return nil, nil
+	}
+
+	items := make([]PoolItem, len(p.items))
+	for i, item := range p.items {
+		items[i] = item
+		items[i].Data = copyBytes(item.Data)
+	}
+
+	return items, nil
+}
+
+func (m *MemoryStore) DeletePool(testID, pool string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pools := m.pools[testID]
+	if _, ok := pools[pool]; !ok {
+		return false, nil
+	}
+
+	delete(pools, pool)
+	if len(pools) == 0 {
+		delete(m.pools, testID)
+	}
+
+	return true, nil
+}
+
+func (m *MemoryStore) LeasePoolItem(
+	testID, pool string, lease PoolItem,
+) (PoolItem, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.pools[testID][pool]
+	if !ok {
+		return PoolItem{}, false, nil
+	}
+
+	now := time.Now()
+	for i, item := range p.items {
+		if item.Leased(now) {
+			continue
+		}
+
+		item.LeaseID = lease.LeaseID
+		item.HolderTestID = lease.HolderTestID
+		item.HolderAgentID = lease.HolderAgentID
+		item.Expires = lease.Expires
+		p.items[i] = item
+
+		item.Data = copyBytes(item.Data)
+
+		return item, true, nil
+	}
+
+	return PoolItem{}, false, nil
+}
+
+func (m *MemoryStore) ReturnPoolItem(testID, pool, leaseID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.pools[testID][pool]
+	if !ok || leaseID == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	for i, item := range p.items {
+		if item.LeaseID == leaseID {
+			p.items[i] = PoolItem{ID: item.ID, Data: item.Data}
+			return item.Leased(now), nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *MemoryStore) ReturnPoolItems(holderTestID, holderAgentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.returnPoolItems(holderTestID, holderAgentID)
+
+	return nil
+}
+
+// returnPoolItems ends leases held by agent, must be called with m.mu held.
+func (m *MemoryStore) returnPoolItems(holderTestID, holderAgentID string) {
+	for _, pools := range m.pools {
+		for _, p := range pools {
+			for i, item := range p.items {
+				if item.LeaseID == "" || item.HolderTestID != holderTestID {
+					continue
+				}
+
+				if holderAgentID == "" || item.HolderAgentID == holderAgentID {
+					p.items[i] = PoolItem{ID: item.ID, Data: item.Data}
+				}
+			}
+		}
+	}
+}
+
 func (m *MemoryStore) DeleteOlderThan(limit time.Time) error {
 	limitUnix := limit.UnixMilli()
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for id, rec := range m.data {
-		if rec.created < limitUnix {
+	for id, records := range m.data {
+		for key, rec := range records {
+			if rec.created < limitUnix {
+				delete(records, key)
+			}
+		}
+
+		if len(records) == 0 {
 			delete(m.data, id)
 		}
 	}
 
+	for id, counters := range m.counters {
+		for name, counter := range counters {
+			if counter.created < limitUnix {
+				delete(counters, name)
+			}
+		}
+
+		if len(counters) == 0 {
+			delete(m.counters, id)
+		}
+	}
+
+	for id, pools := range m.pools {
+		// global pools are not bound to a test and are kept.
+		if id == "" {
+			continue
+		}
+
+		for name, p := range pools {
+			if p.created < limitUnix {
+				delete(pools, name)
+			}
+		}
+
+		if len(pools) == 0 {
+			delete(m.pools, id)
+		}
+	}
+
 	return nil
 }
 
 func (m *MemoryStore) Close() error {
 	return nil
 }
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+
+	copyData := make([]byte, len(data))
+	copy(copyData, data)
+
+	return copyData
+}
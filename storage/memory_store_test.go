@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -8,11 +9,11 @@ import (
 func TestMemoryStore_SaveLoadDelete(t *testing.T) {
 	store := NewMemoryStore()
 
-	if err := store.SaveData(1, []byte("data")); err != nil {
+	if err := store.SaveData("1", []byte("data")); err != nil {
 		t.Fatalf("save failed: %v", err)
 	}
 
-	data, ok, err := store.LoadData(1)
+	data, ok, err := store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load failed: %v", err)
 	}
@@ -20,11 +21,11 @@ func TestMemoryStore_SaveLoadDelete(t *testing.T) {
 		t.Fatalf("unexpected load result: ok=%v data=%q", ok, string(data))
 	}
 
-	if err := store.DeleteData(1); err != nil {
+	if err := store.DeleteData("1"); err != nil {
 		t.Fatalf("delete failed: %v", err)
 	}
 
-	_, ok, err = store.LoadData(1)
+	_, ok, err = store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load after delete failed: %v", err)
 	}
@@ -36,7 +37,7 @@ func TestMemoryStore_SaveLoadDelete(t *testing.T) {
 func TestMemoryStore_DeleteOlderThan(t *testing.T) {
 	store := NewMemoryStore()
 
-	if err := store.SaveData(1, []byte("data")); err != nil {
+	if err := store.SaveData("1", []byte("data")); err != nil {
 		t.Fatalf("save failed: %v", err)
 	}
 
@@ -44,7 +45,7 @@ func TestMemoryStore_DeleteOlderThan(t *testing.T) {
 		t.Fatalf("delete older than failed: %v", err)
 	}
 
-	_, ok, err := store.LoadData(1)
+	_, ok, err := store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load failed: %v", err)
 	}
@@ -52,3 +53,281 @@ func TestMemoryStore_DeleteOlderThan(t *testing.T) {
 		t.Fatal("expected data to be deleted")
 	}
 }
+
+func TestMemoryStore_CompareAndSave(t *testing.T) {
+	testCompareAndSave(t, NewMemoryStore())
+}
+
+// testCompareAndSave checks versioning behaviour shared by all stores.
+func testCompareAndSave(t *testing.T, store DataStore) {
+	t.Helper()
+
+	if _, err := store.CompareAndSave("1", []byte("v1"), 1); err != ErrVersionMismatch {
+		t.Fatalf("expected mismatch for missing data, got %v", err)
+	}
+
+	version, err := store.CompareAndSave("1", []byte("v1"), 0)
+	if err != nil || version != 1 {
+		t.Fatalf("create failed: version=%d err=%v", version, err)
+	}
+
+	if _, err := store.CompareAndSave("1", []byte("v1"), 0); err != ErrVersionMismatch {
+		t.Fatalf("expected mismatch for existing data, got %v", err)
+	}
+
+	version, err = store.CompareAndSave("1", []byte("v2"), 1)
+	if err != nil || version != 2 {
+		t.Fatalf("update failed: version=%d err=%v", version, err)
+	}
+
+	if _, err := store.CompareAndSave("1", []byte("stale"), 1); err != ErrVersionMismatch {
+		t.Fatalf("expected mismatch for stale version, got %v", err)
+	}
+
+	if err := store.SaveData("1", []byte("v3")); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	data, version, ok, err := store.LoadDataVersion("1")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !ok || string(data) != "v3" || version != 3 {
+		t.Fatalf(
+			"unexpected load result: ok=%v data=%q version=%d",
+			ok, string(data), version,
+		)
+	}
+}
+
+func TestMemoryStore_Keys(t *testing.T) {
+	testKeys(t, NewMemoryStore())
+}
+
+// testKeys checks named key behaviour shared by all stores.
+func testKeys(t *testing.T, store DataStore) {
+	t.Helper()
+
+	if err := store.SaveData("1", []byte("blob")); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	version, err := store.CompareAndSaveKey("1", "a", []byte("a1"), 0)
+	if err != nil || version != 1 {
+		t.Fatalf("create key failed: version=%d err=%v", version, err)
+	}
+
+	if _, err := store.CompareAndSaveKey("1", "a", []byte("a2"), 0); err != ErrVersionMismatch {
+		t.Fatalf("expected mismatch for existing key, got %v", err)
+	}
+
+	version, err = store.CompareAndSaveKey("1", "a", []byte("a2"), AnyVersion)
+	if err != nil || version != 2 {
+		t.Fatalf("update key failed: version=%d err=%v", version, err)
+	}
+
+	data, version, ok, err := store.LoadKey("1", "a")
+	if err != nil || !ok || string(data) != "a2" || version != 2 {
+		t.Fatalf(
+			"unexpected key: ok=%v data=%q version=%d err=%v",
+			ok, string(data), version, err,
+		)
+	}
+
+	data, _, ok, err = store.LoadKey("1", DefaultKey)
+	if err != nil || !ok || string(data) != "blob" {
+		t.Fatalf("unexpected default key: ok=%v data=%q err=%v", ok, string(data), err)
+	}
+
+	keys, err := store.ListKeys("1")
+	if err != nil || strings.Join(keys, ",") != "a,default" {
+		t.Fatalf("unexpected keys: %v, err %v", keys, err)
+	}
+
+	if deleted, err := store.DeleteKey("1", DefaultKey); err != nil || !deleted {
+		t.Fatalf("delete default key failed: deleted=%v err=%v", deleted, err)
+	}
+
+	if _, ok, _ := store.LoadData("1"); ok {
+		t.Fatal("expected test data to be deleted with default key")
+	}
+
+	if deleted, err := store.DeleteKey("1", DefaultKey); err != nil || deleted {
+		t.Fatalf("expected missing key, got deleted=%v err=%v", deleted, err)
+	}
+
+	if err := store.DeleteData("1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	keys, err = store.ListKeys("1")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys after delete, got %v, err %v", keys, err)
+	}
+
+	if _, err := store.CompareAndSaveKey("1", "a", []byte("a1"), 0); err != nil {
+		t.Fatalf("create key failed: %v", err)
+	}
+
+	if exists, err := store.TestExists("1"); err != nil || !exists {
+		t.Fatalf("expected test with a key to exist, got %v, err %v", exists, err)
+	}
+}
+
+func TestMemoryStore_Counters(t *testing.T) {
+	testCounters(t, NewMemoryStore())
+}
+
+// testCounters checks counter behaviour shared by all stores.
+func testCounters(t *testing.T, store DataStore) {
+	t.Helper()
+
+	if _, ok, err := store.LoadCounter("1", "users"); err != nil || ok {
+		t.Fatalf("expected missing counter, got ok=%v err=%v", ok, err)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		value, err := store.AddCounter("1", "users", 1)
+		if err != nil || value != i {
+			t.Fatalf("incr failed: value=%d err=%v", value, err)
+		}
+	}
+
+	if value, err := store.AddCounter("1", "users", -5); err != nil || value != -2 {
+		t.Fatalf("decr failed: value=%d err=%v", value, err)
+	}
+
+	if value, ok, err := store.LoadCounter("1", "users"); err != nil || !ok || value != -2 {
+		t.Fatalf("unexpected counter: value=%d ok=%v err=%v", value, ok, err)
+	}
+
+	if exists, err := store.TestExists("1"); err != nil || !exists {
+		t.Fatalf("expected test with a counter to exist, got %v, err %v", exists, err)
+	}
+
+	if err := store.DeleteData("1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if exists, err := store.TestExists("1"); err != nil || exists {
+		t.Fatalf("expected test to be deleted, got %v, err %v", exists, err)
+	}
+
+	if _, ok, err := store.LoadCounter("1", "users"); err != nil || ok {
+		t.Fatalf("expected counter to be deleted, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestMemoryStore_Pools(t *testing.T) {
+	testPools(t, NewMemoryStore())
+}
+
+// testPools checks resource pool behaviour shared by all stores.
+func testPools(t *testing.T, store DataStore) {
+	t.Helper()
+
+	if items, err := store.LoadPool("1", "accounts"); err != nil || len(items) != 0 {
+		t.Fatalf("expected missing pool, got %v, err %v", items, err)
+	}
+
+	items := [][]byte{[]byte(`"alice"`), []byte(`"bob"`)}
+	if err := store.SavePool("1", "accounts", items); err != nil {
+		t.Fatalf("save pool failed: %v", err)
+	}
+
+	if exists, err := store.TestExists("1"); err != nil || !exists {
+		t.Fatalf("expected test with a pool to exist, got %v, err %v", exists, err)
+	}
+
+	lease := func(leaseID, agentID string, expires int64) (PoolItem, bool) {
+		t.Helper()
+
+		item, ok, err := store.LeasePoolItem("1", "accounts", PoolItem{
+			LeaseID:       leaseID,
+			HolderTestID:  "1",
+			HolderAgentID: agentID,
+			Expires:       expires,
+		})
+		if err != nil {
+			t.Fatalf("lease failed: %v", err)
+		}
+
+		return item, ok
+	}
+
+	first, ok := lease("l1", "a", 0)
+	if !ok || first.ID != 1 || string(first.Data) != `"alice"` || first.LeaseID != "l1" {
+		t.Fatalf("unexpected first lease: %+v ok=%v", first, ok)
+	}
+
+	// lease that is already expired leaves the item free.
+	expired, ok := lease("l2", "b", time.Now().Add(-time.Second).UnixMilli())
+	if !ok || expired.ID != 2 {
+		t.Fatalf("unexpected second lease: %+v ok=%v", expired, ok)
+	}
+
+	second, ok := lease("l3", "b", 0)
+	if !ok || second.ID != 2 || string(second.Data) != `"bob"` {
+		t.Fatalf("expected expired item to be leased again, got %+v ok=%v", second, ok)
+	}
+
+	if _, ok := lease("l4", "c", 0); ok {
+		t.Fatal("expected pool to be exhausted")
+	}
+
+	if returned, err := store.ReturnPoolItem("1", "accounts", "l2"); err != nil || returned {
+		t.Fatalf("expected outdated lease to not be returned, got %v err %v", returned, err)
+	}
+
+	if returned, err := store.ReturnPoolItem("1", "accounts", "l1"); err != nil || !returned {
+		t.Fatalf("return failed: returned=%v err=%v", returned, err)
+	}
+
+	if returned, err := store.ReturnPoolItem("1", "accounts", "l1"); err != nil || returned {
+		t.Fatalf("expected lease to be returned once, got %v err %v", returned, err)
+	}
+
+	if err := store.ReturnPoolItems("1", "b"); err != nil {
+		t.Fatalf("return agent items failed: %v", err)
+	}
+
+	loaded, err := store.LoadPool("1", "accounts")
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("load pool failed: %v, err %v", loaded, err)
+	}
+
+	for _, item := range loaded {
+		if item.Leased(time.Now()) {
+			t.Fatalf("expected all items to be free, got %+v", item)
+		}
+	}
+
+	// global pool leased by agent of a deleted test is returned.
+	if err := store.SavePool("", "rooms", [][]byte{[]byte(`1`)}); err != nil {
+		t.Fatalf("save global pool failed: %v", err)
+	}
+
+	_, ok, err = store.LeasePoolItem("", "rooms", PoolItem{
+		LeaseID: "g1", HolderTestID: "1", HolderAgentID: "a",
+	})
+	if err != nil || !ok {
+		t.Fatalf("global lease failed: ok=%v err=%v", ok, err)
+	}
+
+	if err := store.DeleteData("1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if items, err := store.LoadPool("1", "accounts"); err != nil || len(items) != 0 {
+		t.Fatalf("expected pool to be deleted, got %v, err %v", items, err)
+	}
+
+	rooms, err := store.LoadPool("", "rooms")
+	if err != nil || len(rooms) != 1 || rooms[0].Leased(time.Now()) {
+		t.Fatalf("expected global item to be returned, got %+v, err %v", rooms, err)
+	}
+
+	if deleted, err := store.DeletePool("", "rooms"); err != nil || !deleted {
+		t.Fatalf("delete pool failed: deleted=%v err=%v", deleted, err)
+	}
+}
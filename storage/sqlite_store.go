@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -12,6 +13,60 @@ type SQLiteStore struct {
 	db *sql.DB
 }
 
+// migrations hold sqlite schema changes in order of application. Number of
+// applied migrations is kept in user_version pragma.
+var migrations = []string{
+	// initial schema with numeric test IDs.
+	`CREATE TABLE IF NOT EXISTS test_data (
+		test_id INTEGER PRIMARY KEY,
+		data BLOB,
+		created_at INTEGER NOT NULL
+	)`,
+	// test IDs are opaque strings, existing numeric IDs are kept as text.
+	`CREATE TABLE test_data_text (
+		test_id TEXT PRIMARY KEY,
+		data BLOB,
+		created_at INTEGER NOT NULL
+	);
+	INSERT INTO test_data_text (test_id, data, created_at)
+		SELECT CAST(test_id AS TEXT), data, created_at FROM test_data;
+	DROP TABLE test_data;
+	ALTER TABLE test_data_text RENAME TO test_data`,
+	// data versions for optimistic concurrency.
+	`ALTER TABLE test_data ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	// named keys within a test, test data itself stays in test_data.
+	`CREATE TABLE test_keys (
+		test_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		data BLOB,
+		version INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (test_id, key)
+	)`,
+	// atomic counters within a test.
+	`CREATE TABLE test_counters (
+		test_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (test_id, name)
+	)`,
+	// resource pools with item leases, global pools have empty test ID.
+	`CREATE TABLE test_pools (
+		test_id TEXT NOT NULL,
+		pool TEXT NOT NULL,
+		item_id INTEGER NOT NULL,
+		data BLOB,
+		lease_id TEXT NOT NULL DEFAULT '',
+		holder_test_id TEXT NOT NULL DEFAULT '',
+		holder_agent_id TEXT NOT NULL DEFAULT '',
+		lease_expires INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (test_id, pool, item_id)
+	);
+	CREATE INDEX test_pools_holder ON test_pools (holder_test_id, holder_agent_id)`,
+}
+
 // NewSQLiteStore initializes sqlite store at given path.
 func NewSQLiteStore(path string) (*SQLiteStore, error) {
 	db, err := sql.Open("sqlite", path)
@@ -19,13 +74,7 @@ func NewSQLiteStore(path string) (*SQLiteStore, error) {
 		return nil, err
 	}
 
-	if _, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS test_data (
-			test_id INTEGER PRIMARY KEY,
-			data BLOB,
-			created_at INTEGER NOT NULL
-		)
-	`); err != nil {
+	if err := migrate(db); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
@@ -33,38 +82,465 @@ func NewSQLiteStore(path string) (*SQLiteStore, error) {
 	return &SQLiteStore{db: db}, nil
 }
 
-func (s *SQLiteStore) SaveData(testID int, data []byte) error {
-	_, err := s.db.Exec(
-		`INSERT INTO test_data (test_id, data, created_at)
-		 VALUES (?, ?, ?)
-		 ON CONFLICT(test_id) DO UPDATE SET data=excluded.data, created_at=excluded.created_at`,
-		testID,
-		data,
-		time.Now().UnixMilli(),
-	)
+// migrate applies migrations that are not yet applied to the database.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) SaveData(testID string, data []byte) error {
+	_, err := s.CompareAndSave(testID, data, AnyVersion)
 	return err
 }
 
-func (s *SQLiteStore) LoadData(testID int) ([]byte, bool, error) {
-	row := s.db.QueryRow(`SELECT data FROM test_data WHERE test_id = ?`, testID)
-	var data []byte
-	if err := row.Scan(&data); err != nil {
+func (s *SQLiteStore) LoadData(testID string) ([]byte, bool, error) {
+	data, _, ok, err := s.LoadDataVersion(testID)
+	return data, ok, err
+}
+
+func (s *SQLiteStore) LoadDataVersion(testID string) ([]byte, int64, bool, error) {
+	row := s.db.QueryRow(
+		`SELECT data, version FROM test_data WHERE test_id = ?`, testID,
+	)
+
+	var (
+		data    []byte
+		version int64
+	)
+	if err := row.Scan(&data, &version); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, false, nil
+		}
+		return nil, 0, false, err
+	}
+
+	return data, version, true, nil
+}
+
+func (s *SQLiteStore) CompareAndSave(
+	testID string, data []byte, expected int64,
+) (int64, error) {
+	now := time.Now().UnixMilli()
+
+	var (
+		row *sql.Row
+		err error
+	)
+
+	switch {
+	case expected == AnyVersion:
+		row = s.db.QueryRow(
+			`INSERT INTO test_data (test_id, data, created_at, version)
+			 VALUES (?, ?, ?, 1)
+			 ON CONFLICT(test_id) DO UPDATE SET data=excluded.data,
+			 created_at=excluded.created_at, version=test_data.version + 1
+			 RETURNING version`,
+			testID, data, now,
+		)
+	case expected == 0:
+		row = s.db.QueryRow(
+			`INSERT INTO test_data (test_id, data, created_at, version)
+			 VALUES (?, ?, ?, 1)
+			 ON CONFLICT(test_id) DO NOTHING
+			 RETURNING version`,
+			testID, data, now,
+		)
+	default:
+		row = s.db.QueryRow(
+			`UPDATE test_data SET data = ?, created_at = ?, version = version + 1
+			 WHERE test_id = ? AND version = ?
+			 RETURNING version`,
+			data, now, testID, expected,
+		)
+	}
+
+	var version int64
+	if err = row.Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrVersionMismatch
+		}
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (s *SQLiteStore) DeleteData(testID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM test_data WHERE test_id = ?`,
+		`DELETE FROM test_keys WHERE test_id = ?`,
+		`DELETE FROM test_counters WHERE test_id = ?`,
+		`DELETE FROM test_pools WHERE test_id = ?`,
+		`UPDATE test_pools SET lease_id = '', holder_test_id = '',
+		 holder_agent_id = '', lease_expires = 0 WHERE holder_test_id = ?`,
+	} {
+		if _, err := tx.Exec(query, testID); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) TestExists(testID string) (bool, error) {
+	var exists bool
+
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM test_data WHERE test_id = ?)
+		 OR EXISTS (SELECT 1 FROM test_keys WHERE test_id = ?)
+		 OR EXISTS (SELECT 1 FROM test_counters WHERE test_id = ?)
+		 OR EXISTS (SELECT 1 FROM test_pools WHERE test_id = ?)`,
+		testID, testID, testID, testID,
+	).Scan(&exists)
+
+	return exists, err
+}
+
+func (s *SQLiteStore) LoadKey(testID, key string) ([]byte, int64, bool, error) {
+	if key == DefaultKey {
+		return s.LoadDataVersion(testID)
+	}
+
+	row := s.db.QueryRow(
+		`SELECT data, version FROM test_keys WHERE test_id = ? AND key = ?`,
+		testID, key,
+	)
+
+	var (
+		data    []byte
+		version int64
+	)
+	if err := row.Scan(&data, &version); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, false, nil
+			return nil, 0, false, nil
 		}
-		return nil, false, err
+		return nil, 0, false, err
 	}
 
-	return data, true, nil
+	return data, version, true, nil
 }
 
-func (s *SQLiteStore) DeleteData(testID int) error {
-	_, err := s.db.Exec(`DELETE FROM test_data WHERE test_id = ?`, testID)
+func (s *SQLiteStore) CompareAndSaveKey(
+	testID, key string, data []byte, expected int64,
+) (int64, error) {
+	if key == DefaultKey {
+		return s.CompareAndSave(testID, data, expected)
+	}
+
+	now := time.Now().UnixMilli()
+
+	var row *sql.Row
+
+	switch {
+	case expected == AnyVersion:
+		row = s.db.QueryRow(
+			`INSERT INTO test_keys (test_id, key, data, created_at, version)
+			 VALUES (?, ?, ?, ?, 1)
+			 ON CONFLICT(test_id, key) DO UPDATE SET data=excluded.data,
+			 created_at=excluded.created_at, version=test_keys.version + 1
+			 RETURNING version`,
+			testID, key, data, now,
+		)
+	case expected == 0:
+		row = s.db.QueryRow(
+			`INSERT INTO test_keys (test_id, key, data, created_at, version)
+			 VALUES (?, ?, ?, ?, 1)
+			 ON CONFLICT(test_id, key) DO NOTHING
+			 RETURNING version`,
+			testID, key, data, now,
+		)
+	default:
+		row = s.db.QueryRow(
+			`UPDATE test_keys SET data = ?, created_at = ?, version = version + 1
+			 WHERE test_id = ? AND key = ? AND version = ?
+			 RETURNING version`,
+			data, now, testID, key, expected,
+		)
+	}
+
+	var version int64
+	if err := row.Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrVersionMismatch
+		}
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (s *SQLiteStore) DeleteKey(testID, key string) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+
+	if key == DefaultKey {
+		res, err = s.db.Exec(`DELETE FROM test_data WHERE test_id = ?`, testID)
+	} else {
+		res, err = s.db.Exec(
+			`DELETE FROM test_keys WHERE test_id = ? AND key = ?`, testID, key,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (s *SQLiteStore) ListKeys(testID string) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT ? FROM test_data WHERE test_id = ?
+		 UNION SELECT key FROM test_keys WHERE test_id = ?
+		 ORDER BY 1`,
+		DefaultKey, testID, testID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) AddCounter(testID, name string, delta int64) (int64, error) {
+	var value int64
+
+	err := s.db.QueryRow(
+		`INSERT INTO test_counters (test_id, name, value, created_at)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT(test_id, name) DO UPDATE SET
+		 value = test_counters.value + excluded.value,
+		 created_at = excluded.created_at
+		 RETURNING value`,
+		testID, name, delta, time.Now().UnixMilli(),
+	).Scan(&value)
+
+	return value, err
+}
+
+func (s *SQLiteStore) LoadCounter(testID, name string) (int64, bool, error) {
+	var value int64
+
+	err := s.db.QueryRow(
+		`SELECT value FROM test_counters WHERE test_id = ? AND name = ?`,
+		testID, name,
+	).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return value, true, nil
+}
+
+func (s *SQLiteStore) SavePool(testID, pool string, items [][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`DELETE FROM test_pools WHERE test_id = ? AND pool = ?`, testID, pool,
+	)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	for i, item := range items {
+		_, err = tx.Exec(
+			`INSERT INTO test_pools (test_id, pool, item_id, data, created_at)
+			 VALUES (?, ?, ?, ?, ?)`,
+			testID, pool, i+1, item, now,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LoadPool(testID, pool string) ([]PoolItem, error) {
+	rows, err := s.db.Query(
+		`SELECT item_id, data, lease_id, holder_test_id, holder_agent_id,
+		 lease_expires FROM test_pools WHERE test_id = ? AND pool = ?
+		 ORDER BY item_id`,
+		testID, pool,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []PoolItem
+	for rows.Next() {
+		var item PoolItem
+		err := rows.Scan(
+			&item.ID, &item.Data, &item.LeaseID, &item.HolderTestID,
+			&item.HolderAgentID, &item.Expires,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *SQLiteStore) DeletePool(testID, pool string) (bool, error) {
+	res, err := s.db.Exec(
+		`DELETE FROM test_pools WHERE test_id = ? AND pool = ?`, testID, pool,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (s *SQLiteStore) LeasePoolItem(
+	testID, pool string, lease PoolItem,
+) (PoolItem, bool, error) {
+	item := lease
+
+	err := s.db.QueryRow(
+		`UPDATE test_pools SET lease_id = ?, holder_test_id = ?,
+		 holder_agent_id = ?, lease_expires = ?
+		 WHERE rowid = (
+			SELECT rowid FROM test_pools
+			WHERE test_id = ? AND pool = ? AND (lease_id = ''
+			OR (lease_expires > 0 AND lease_expires <= ?))
+			ORDER BY item_id LIMIT 1
+		 )
+		 RETURNING item_id, data`,
+		lease.LeaseID, lease.HolderTestID, lease.HolderAgentID, lease.Expires,
+		testID, pool, time.Now().UnixMilli(),
+	).Scan(&item.ID, &item.Data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PoolItem{}, false, nil
+		}
+		return PoolItem{}, false, err
+	}
+
+	return item, true, nil
+}
+
+func (s *SQLiteStore) ReturnPoolItem(testID, pool, leaseID string) (bool, error) {
+	if leaseID == "" {
+		return false, nil
+	}
+
+	// active lease is returned first, so the second statement only clears
+	// an expired one.
+	res, err := s.db.Exec(
+		`UPDATE test_pools SET lease_id = '', holder_test_id = '',
+		 holder_agent_id = '', lease_expires = 0
+		 WHERE test_id = ? AND pool = ? AND lease_id = ?
+		 AND (lease_expires = 0 OR lease_expires > ?)`,
+		testID, pool, leaseID, time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.db.Exec(
+		`UPDATE test_pools SET lease_id = '', holder_test_id = '',
+		 holder_agent_id = '', lease_expires = 0
+		 WHERE test_id = ? AND pool = ? AND lease_id = ?`,
+		testID, pool, leaseID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (s *SQLiteStore) ReturnPoolItems(holderTestID, holderAgentID string) error {
+	_, err := s.db.Exec(
+		`UPDATE test_pools SET lease_id = '', holder_test_id = '',
+		 holder_agent_id = '', lease_expires = 0
+		 WHERE lease_id != '' AND holder_test_id = ?
+		 AND (? = '' OR holder_agent_id = ?)`,
+		holderTestID, holderAgentID, holderAgentID,
+	)
 	return err
 }
 
 func (s *SQLiteStore) DeleteOlderThan(limit time.Time) error {
-	_, err := s.db.Exec(`DELETE FROM test_data WHERE created_at < ?`, limit.UnixMilli())
+	_, err := s.db.Exec(
+		`DELETE FROM test_data WHERE created_at < ?;
+		 DELETE FROM test_keys WHERE created_at < ?;
+		 DELETE FROM test_counters WHERE created_at < ?;
+		 DELETE FROM test_pools WHERE test_id != '' AND created_at < ?`,
+		limit.UnixMilli(), limit.UnixMilli(), limit.UnixMilli(), limit.UnixMilli(),
+	)
 	return err
 }
 
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"database/sql"
 	"path/filepath"
 	"testing"
 	"time"
@@ -14,11 +15,11 @@ func TestSQLiteStore_SaveLoadDelete(t *testing.T) {
 	}
 	t.Cleanup(func() { _ = store.Close() })
 
-	if err := store.SaveData(1, []byte("data")); err != nil {
+	if err := store.SaveData("1", []byte("data")); err != nil {
 		t.Fatalf("save failed: %v", err)
 	}
 
-	data, ok, err := store.LoadData(1)
+	data, ok, err := store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load failed: %v", err)
 	}
@@ -26,11 +27,11 @@ func TestSQLiteStore_SaveLoadDelete(t *testing.T) {
 		t.Fatalf("unexpected load result: ok=%v data=%q", ok, string(data))
 	}
 
-	if err := store.DeleteData(1); err != nil {
+	if err := store.DeleteData("1"); err != nil {
 		t.Fatalf("delete failed: %v", err)
 	}
 
-	_, ok, err = store.LoadData(1)
+	_, ok, err = store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load after delete failed: %v", err)
 	}
@@ -47,7 +48,7 @@ func TestSQLiteStore_DeleteOlderThan(t *testing.T) {
 	}
 	t.Cleanup(func() { _ = store.Close() })
 
-	if err := store.SaveData(1, []byte("data")); err != nil {
+	if err := store.SaveData("1", []byte("data")); err != nil {
 		t.Fatalf("save failed: %v", err)
 	}
 
@@ -55,7 +56,7 @@ func TestSQLiteStore_DeleteOlderThan(t *testing.T) {
 		t.Fatalf("delete older than failed: %v", err)
 	}
 
-	_, ok, err := store.LoadData(1)
+	_, ok, err := store.LoadData("1")
 	if err != nil {
 		t.Fatalf("load failed: %v", err)
 	}
@@ -63,3 +64,132 @@ func TestSQLiteStore_DeleteOlderThan(t *testing.T) {
 		t.Fatal("expected data to be deleted")
 	}
 }
+
+func TestSQLiteStore_MigratesNumericTestIDs(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open sqlite db: %v", err)
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE test_data (
+			test_id INTEGER PRIMARY KEY,
+			data BLOB,
+			created_at INTEGER NOT NULL
+		);
+		INSERT INTO test_data (test_id, data, created_at) VALUES (42, 'legacy', 1);
+	`); err != nil {
+		t.Fatalf("failed to create legacy schema: %v", err)
+	}
+	_ = db.Close()
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	data, ok, err := store.LoadData("42")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !ok || string(data) != "legacy" {
+		t.Fatalf("unexpected load result: ok=%v data=%q", ok, string(data))
+	}
+
+	if err := store.SaveData("pr-1234-chrome-7f3a", []byte("data")); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	data, ok, err = store.LoadData("pr-1234-chrome-7f3a")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !ok || string(data) != "data" {
+		t.Fatalf("unexpected load result: ok=%v data=%q", ok, string(data))
+	}
+}
+
+func TestSQLiteStore_CompareAndSave(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	testCompareAndSave(t, store)
+}
+
+func TestSQLiteStore_Keys(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	testKeys(t, store)
+}
+
+func TestSQLiteStore_Counters(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	testCounters(t, store)
+}
+
+func TestSQLiteStore_Pools(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	testPools(t, store)
+}
+
+func TestSQLiteStore_PoolLeasesSurviveRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "testsync.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create sqlite store: %v", err)
+	}
+
+	if err := store.SavePool("", "accounts", [][]byte{[]byte(`"alice"`)}); err != nil {
+		t.Fatalf("save pool failed: %v", err)
+	}
+
+	_, ok, err := store.LeasePoolItem("", "accounts", PoolItem{
+		LeaseID: "l1", HolderTestID: "1", HolderAgentID: "a",
+	})
+	if err != nil || !ok {
+		t.Fatalf("lease failed: ok=%v err=%v", ok, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	store, err = NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	items, err := store.LoadPool("", "accounts")
+	if err != nil || len(items) != 1 || items[0].LeaseID != "l1" {
+		t.Fatalf("expected lease to be kept, got %+v, err %v", items, err)
+	}
+
+	if _, ok, err := store.LeasePoolItem("", "accounts", PoolItem{LeaseID: "l2"}); err != nil || ok {
+		t.Fatalf("expected pool to be exhausted, got ok=%v err=%v", ok, err)
+	}
+}
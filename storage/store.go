@@ -1,12 +1,97 @@
 package storage
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
-// DataStore defines persistence for test data.
+const (
+	// AnyVersion disables version check in CompareAndSave.
+	AnyVersion int64 = -1
+	// DefaultKey names the key that holds the whole test data blob.
+	DefaultKey = "default"
+)
+
+// ErrVersionMismatch indicates that stored data version differs from the
+// expected one.
+var ErrVersionMismatch = errors.New("data version mismatch")
+
+// PoolItem describes an item of a resource pool together with its lease.
+type PoolItem struct {
+	// ID identifies item within pool, items are numbered from 1 in order
+	// they were uploaded.
+	ID   int64
+	Data []byte
+	// LeaseID identifies the current lease, empty if item is free.
+	LeaseID string
+	// HolderTestID and HolderAgentID identify agent holding the lease.
+	HolderTestID  string
+	HolderAgentID string
+	// Expires is lease expiry in unix milliseconds, 0 if lease has no TTL.
+	// Items with expired lease are free.
+	Expires int64
+}
+
+// Leased reports whether item is leased at provided time.
+func (i PoolItem) Leased(now time.Time) bool {
+	return i.LeaseID != "" && (i.Expires == 0 || i.Expires > now.UnixMilli())
+}
+
+// DataStore defines persistence for test data. Every write of test data
+// increases its version, starting from 1.
 type DataStore interface {
-	SaveData(testID int, data []byte) error
-	LoadData(testID int) ([]byte, bool, error)
-	DeleteData(testID int) error
+	SaveData(testID string, data []byte) error
+	LoadData(testID string) ([]byte, bool, error)
+	// LoadDataVersion retrieves test data together with its version.
+	LoadDataVersion(testID string) ([]byte, int64, bool, error)
+	// CompareAndSave stores test data only if its current version matches
+	// expected one and returns the new version. Expected version 0 requires
+	// data to not exist, AnyVersion skips the check.
+	CompareAndSave(testID string, data []byte, expected int64) (int64, error)
+	// DeleteData removes test data together with all of its keys, counters
+	// and pools. Items leased by agents of the test are returned.
+	DeleteData(testID string) error
+	// TestExists reports whether test data, keys, counters or pools are
+	// stored for test.
+	TestExists(testID string) (bool, error)
+
+	// LoadKey retrieves value of a named key within test together with its
+	// version. DefaultKey refers to test data.
+	LoadKey(testID, key string) ([]byte, int64, bool, error)
+	// CompareAndSaveKey stores value of a named key, versioned the same way
+	// as CompareAndSave.
+	CompareAndSaveKey(testID, key string, data []byte, expected int64) (int64, error)
+	// DeleteKey removes a named key and reports whether it existed.
+	DeleteKey(testID, key string) (bool, error)
+	// ListKeys returns sorted names of stored keys within test.
+	ListKeys(testID string) ([]string, error)
+
+	// AddCounter atomically adds delta to a named counter within test,
+	// starting from 0, and returns the new value.
+	AddCounter(testID, name string, delta int64) (int64, error)
+	// LoadCounter retrieves value of a named counter.
+	LoadCounter(testID, name string) (int64, bool, error)
+
+	// SavePool replaces items of a named resource pool, dropping existing
+	// leases. Pools of an empty test ID are global.
+	SavePool(testID, pool string, items [][]byte) error
+	// LoadPool returns items of a pool ordered by ID, none if pool does not
+	// exist.
+	LoadPool(testID, pool string) ([]PoolItem, error)
+	// DeletePool removes a pool and reports whether it existed.
+	DeletePool(testID, pool string) (bool, error)
+	// LeasePoolItem atomically leases the first free item of a pool, taking
+	// lease ID, holder and expiry from lease. Returns the leased item or
+	// false if no item is free.
+	LeasePoolItem(testID, pool string, lease PoolItem) (PoolItem, bool, error)
+	// ReturnPoolItem ends a lease and reports whether it was active.
+	ReturnPoolItem(testID, pool, leaseID string) (bool, error)
+	// ReturnPoolItems ends all leases held by an agent across pools. Empty
+	// agent ID ends leases of all agents of the holder test.
+	ReturnPoolItems(holderTestID, holderAgentID string) error
+
+	// DeleteOlderThan removes data created before limit. Global pools are
+	// kept.
 	DeleteOlderThan(limit time.Time) error
 	Close() error
 }
@@ -24,7 +24,7 @@ func main() {
 	username := getEnv("TESTSYNC_USER", "exampleUserName")
 	password := getEnv("TESTSYNC_PASS", "examplePassWord")
 
-	testID := 12345
+	testID := "e2e-12345"
 	payload := []byte("payload-e2e")
 
 	if err := httpCreate(httpURL, testID, payload, username, password); err != nil {
@@ -42,8 +42,8 @@ func main() {
 	fmt.Println("E2E flow completed successfully")
 }
 
-func httpCreate(baseURL string, testID int, payload []byte, user, pass string) error {
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/tests/%d", baseURL, testID), bytes.NewReader(payload))
+func httpCreate(baseURL string, testID string, payload []byte, user, pass string) error {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/tests/%s", baseURL, testID), bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
@@ -63,8 +63,8 @@ func httpCreate(baseURL string, testID int, payload []byte, user, pass string) e
 	return nil
 }
 
-func httpRead(baseURL string, testID int, payload []byte, user, pass string) error {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/tests/%d", baseURL, testID), nil)
+func httpRead(baseURL string, testID string, payload []byte, user, pass string) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/tests/%s", baseURL, testID), nil)
 	if err != nil {
 		return err
 	}
@@ -93,8 +93,8 @@ func httpRead(baseURL string, testID int, payload []byte, user, pass string) err
 	return nil
 }
 
-func wsFlow(baseURL string, testID int, payload []byte, user, pass string) error {
-	url := fmt.Sprintf("%s/register/%d", baseURL, testID)
+func wsFlow(baseURL string, testID string, payload []byte, user, pass string) error {
+	url := fmt.Sprintf("%s/register/%s", baseURL, testID)
 	header := http.Header{}
 	if user != "" || pass != "" {
 		header.Set("Authorization", "Basic "+basicAuth(user, pass))
@@ -16,6 +16,8 @@ type Config struct {
 	Logging    LogConfig        `json:"logging"`
 	SyncClient BasicCredentials `json:"sync_client"`
 	Storage    StorageConfig    `json:"storage"`
+	WebSocket  WebSocketConfig  `json:"websocket"`
+	Checkpoint CheckpointConfig `json:"checkpoint"`
 }
 
 // BasicCredentials defines generic client details.
@@ -44,6 +46,21 @@ type StorageConfig struct {
 	SQLitePath string `json:"sqlite_path"`
 }
 
+// WebSocketConfig defines settings for WebSocket agent sessions.
+type WebSocketConfig struct {
+	// ResumeGracePeriodMS defines how long a disconnected agent can resume
+	// its session. Defaults to 30000, negative value disables session resume.
+	ResumeGracePeriodMS int `json:"resume_grace_period_ms"`
+}
+
+// CheckpointConfig defines settings of checkpoints.
+type CheckpointConfig struct {
+	// StartDelayMS defines how long after release released connections
+	// start, unless checkpoint sets its own delay. Defaults to 500 when not
+	// set, zero or negative value starts them right away.
+	StartDelayMS *int `json:"start_delay_ms"`
+}
+
 // ApplyDefaults fills in default values for missing config fields.
 func ApplyDefaults(conf *Config) {
 	if conf == nil {
@@ -61,6 +78,15 @@ func ApplyDefaults(conf *Config) {
 	if conf.Storage.Type == "" {
 		conf.Storage.Type = "memory"
 	}
+
+	if conf.WebSocket.ResumeGracePeriodMS == 0 {
+		conf.WebSocket.ResumeGracePeriodMS = 30000
+	}
+
+	if conf.Checkpoint.StartDelayMS == nil {
+		delay := 500
+		conf.Checkpoint.StartDelayMS = &delay
+	}
 }
 
 // ReadConfig reads file into given config object.
@@ -68,4 +68,29 @@ func TestApplyDefaults(t *testing.T) {
 	if cfg.Storage.Type != "memory" {
 		t.Fatalf("expected default storage type memory, got %q", cfg.Storage.Type)
 	}
+	if cfg.WebSocket.ResumeGracePeriodMS != 30000 {
+		t.Fatalf(
+			"expected default resume grace period 30000, got %d",
+			cfg.WebSocket.ResumeGracePeriodMS,
+		)
+	}
+	if cfg.Checkpoint.StartDelayMS == nil || *cfg.Checkpoint.StartDelayMS != 500 {
+		t.Fatalf(
+			"expected default checkpoint start delay 500, got %v",
+			cfg.Checkpoint.StartDelayMS,
+		)
+	}
+}
+
+func TestApplyDefaults_ZeroStartDelay(t *testing.T) {
+	delay := 0
+	cfg := Config{Checkpoint: CheckpointConfig{StartDelayMS: &delay}}
+	ApplyDefaults(&cfg)
+
+	if *cfg.Checkpoint.StartDelayMS != 0 {
+		t.Fatalf(
+			"expected zero start delay to be kept, got %d",
+			*cfg.Checkpoint.StartDelayMS,
+		)
+	}
 }
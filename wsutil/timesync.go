@@ -0,0 +1,142 @@
+package wsutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// CommandTimeSync is the WS command exchanging timestamps with the server.
+const CommandTimeSync = "time_sync"
+
+// TimeSync describes content of time_sync request and reply. Timestamps are
+// epoch micros, server ones are only set in the reply.
+type TimeSync struct {
+	// ClientSend is echoed back by the server.
+	ClientSend    int64 `json:"client_send"`
+	ServerReceive int64 `json:"server_receive,omitempty"`
+	ServerSend    int64 `json:"server_send,omitempty"`
+}
+
+// TimeSample describes a single time_sync exchange.
+type TimeSample struct {
+	ClientSend    time.Time
+	ServerReceive time.Time
+	ServerSend    time.Time
+	ClientReceive time.Time
+}
+
+// Offset returns how far server clock is ahead of the local one.
+func (s TimeSample) Offset() time.Duration {
+	return (s.ServerReceive.Sub(s.ClientSend) + s.ServerSend.Sub(s.ClientReceive)) / 2
+}
+
+// RoundTrip returns time the exchange spent in network.
+func (s TimeSample) RoundTrip() time.Duration {
+	return s.ClientReceive.Sub(s.ClientSend) - s.ServerSend.Sub(s.ServerReceive)
+}
+
+// ClockOffset describes difference between server and local clocks.
+type ClockOffset struct {
+	// Offset tells how far server clock is ahead of the local one.
+	Offset time.Duration
+	// RoundTrip is the round trip of the sample offset was taken from. The
+	// offset may be wrong by up to half of it.
+	RoundTrip time.Duration
+}
+
+// EstimateClockOffset returns offset of the sample with the shortest round
+// trip, as it's the least affected by network delays.
+func EstimateClockOffset(samples []TimeSample) (ClockOffset, error) {
+	if len(samples) == 0 {
+		return ClockOffset{}, errors.New("no time samples provided")
+	}
+
+	sorted := make([]TimeSample, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].RoundTrip() < sorted[j].RoundTrip()
+	})
+
+	return ClockOffset{
+		Offset:    sorted[0].Offset(),
+		RoundTrip: sorted[0].RoundTrip(),
+	}, nil
+}
+
+// LocalTime converts server epoch millis, e.g. start_at of a checkpoint, to
+// local time.
+func (o ClockOffset) LocalTime(serverMillis int64) time.Time {
+	return time.UnixMilli(serverMillis).Add(-o.Offset)
+}
+
+// SyncClock exchanges provided number of time_sync messages over connection
+// and estimates clock offset from them. Messages are exchanged one by one, so
+// connection must not be read by anyone else meanwhile. Other messages
+// received during the exchange are dropped.
+func SyncClock(conn *websocket.Conn, samples int) (ClockOffset, error) {
+	collected := make([]TimeSample, 0, samples)
+
+	for i := 0; i < samples; i++ {
+		id := fmt.Sprintf("time-sync-%d", i)
+		sent := time.Now()
+
+		err := SendReply(conn, id, CommandTimeSync, TimeSync{
+			ClientSend: sent.UnixMicro(),
+		})
+		if err != nil {
+			return ClockOffset{}, err
+		}
+
+		reply, err := readTimeSync(conn, id)
+		if err != nil {
+			return ClockOffset{}, err
+		}
+
+		collected = append(collected, TimeSample{
+			ClientSend:    sent,
+			ServerReceive: time.UnixMicro(reply.ServerReceive),
+			ServerSend:    time.UnixMicro(reply.ServerSend),
+			ClientReceive: time.Now(),
+		})
+	}
+
+	return EstimateClockOffset(collected)
+}
+
+// readTimeSync reads messages until time_sync reply to request with provided
+// ID arrives.
+func readTimeSync(conn *websocket.Conn, id string) (TimeSync, error) {
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return TimeSync{}, errors.Wrap(err, "could not read time_sync reply")
+		}
+
+		var m Message
+		if err := json.Unmarshal(body, &m); err != nil {
+			return TimeSync{}, errors.Wrap(err, "could not unmarshal message")
+		}
+
+		if m.ID != id {
+			continue
+		}
+
+		if m.Command != CommandTimeSync {
+			return TimeSync{}, errors.Errorf(
+				"time_sync failed: %s", string(m.Content.Bytes),
+			)
+		}
+
+		var reply TimeSync
+		if err := json.Unmarshal(m.Content.Bytes, &reply); err != nil {
+			return TimeSync{}, errors.Wrap(err, "could not unmarshal time_sync reply")
+		}
+
+		return reply, nil
+	}
+}
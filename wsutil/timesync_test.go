@@ -0,0 +1,165 @@
+package wsutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sample returns time sample with timestamps given in millis from a fixed
+// base.
+func sample(t0, t1, t2, t3 int64) TimeSample {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int64) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	return TimeSample{
+		ClientSend:    at(t0),
+		ServerReceive: at(t1),
+		ServerSend:    at(t2),
+		ClientReceive: at(t3),
+	}
+}
+
+func TestTimeSample(t *testing.T) {
+	cases := []struct {
+		name      string
+		sample    TimeSample
+		offset    time.Duration
+		roundTrip time.Duration
+	}{
+		{"equal clocks", sample(0, 0, 0, 0), 0, 0},
+		// 10ms each way, server handles message in 2ms.
+		{"server ahead", sample(0, 110, 112, 22), 100 * time.Millisecond, 20 * time.Millisecond},
+		{"server behind", sample(0, -40, -38, 22), -50 * time.Millisecond, 20 * time.Millisecond},
+		// 30ms there and 10ms back, offset is off by half of the difference.
+		{"asymmetric delay", sample(0, 30, 30, 40), 10 * time.Millisecond, 40 * time.Millisecond},
+	}
+
+	for _, tc := range cases {
+		if offset := tc.sample.Offset(); offset != tc.offset {
+			t.Fatalf("%s: expected offset %s, got %s", tc.name, tc.offset, offset)
+		}
+
+		if roundTrip := tc.sample.RoundTrip(); roundTrip != tc.roundTrip {
+			t.Fatalf(
+				"%s: expected round trip %s, got %s",
+				tc.name, tc.roundTrip, roundTrip,
+			)
+		}
+	}
+}
+
+func TestEstimateClockOffset(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []TimeSample
+		want    ClockOffset
+	}{
+		{
+			"single sample",
+			[]TimeSample{sample(0, 110, 112, 22)},
+			ClockOffset{Offset: 100 * time.Millisecond, RoundTrip: 20 * time.Millisecond},
+		},
+		{
+			"shortest round trip wins",
+			[]TimeSample{
+				sample(0, 130, 130, 40),
+				sample(100, 205, 206, 111),
+				sample(200, 330, 331, 251),
+			},
+			ClockOffset{Offset: 100 * time.Millisecond, RoundTrip: 10 * time.Millisecond},
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := EstimateClockOffset(tc.samples)
+		if err != nil {
+			t.Fatalf("%s: estimate failed: %v", tc.name, err)
+		}
+
+		if got != tc.want {
+			t.Fatalf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+
+	if _, err := EstimateClockOffset(nil); err == nil {
+		t.Fatal("expected error without samples")
+	}
+}
+
+func TestClockOffset_LocalTime(t *testing.T) {
+	server := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).UnixMilli()
+
+	cases := []struct {
+		offset time.Duration
+		want   time.Time
+	}{
+		{0, time.UnixMilli(server)},
+		{100 * time.Millisecond, time.UnixMilli(server - 100)},
+		{-2 * time.Second, time.UnixMilli(server + 2000)},
+	}
+
+	for _, tc := range cases {
+		got := ClockOffset{Offset: tc.offset}.LocalTime(server)
+		if !got.Equal(tc.want) {
+			t.Fatalf("offset %s: expected %s, got %s", tc.offset, tc.want, got)
+		}
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+
+	// server is a minute ahead and sends an unrelated message before every
+	// time_sync reply.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var m Message
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+
+			var req TimeSync
+			if err := json.Unmarshal(m.Content.Bytes, &req); err != nil {
+				return
+			}
+
+			now := time.Now().Add(time.Minute).UnixMicro()
+			_ = SendMessage(conn, "broadcast", map[string]string{"a": "b"})
+			_ = SendReply(conn, m.ID, CommandTimeSync, TimeSync{
+				ClientSend:    req.ClientSend,
+				ServerReceive: now,
+				ServerSend:    now,
+			})
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := Connect("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	offset, err := SyncClock(conn, 3)
+	if err != nil {
+		t.Fatalf("sync clock failed: %v", err)
+	}
+
+	if diff := offset.Offset - time.Minute; diff < -time.Second || diff > time.Second {
+		t.Fatalf("expected offset of about a minute, got %s", offset.Offset)
+	}
+}
@@ -13,6 +13,8 @@ type HandlerFunc func(b []byte)
 
 // Message describes the body that WS should receive.
 type Message struct {
+	// ID is an optional client supplied request identifier.
+	ID      string     `json:"id,omitempty"`
 	Command string     `json:"command"`
 	Content RawMessage `json:"content"`
 }
@@ -41,25 +43,49 @@ func Connect(url string) (*websocket.Conn, *http.Response, error) {
 	return websocket.DefaultDialer.Dial(url, http.Header{})
 }
 
-// SendMessage marshals and sends a message in the provided WebSocket
-// connection. This function uses Message struct to send messages in correct
+// NewMessage marshals command and its content into a message in Message
 // format.
-func SendMessage(conn *websocket.Conn, cmd string, content interface{}) error {
-	if conn == nil {
-		return errors.New("no websocket connection provided")
-	}
+func NewMessage(cmd string, content interface{}) ([]byte, error) {
+	return NewReply("", cmd, content)
+}
 
+// NewReply marshals command and its content into a message in Message format
+// with ID of the request it replies to.
+func NewReply(id, cmd string, content interface{}) ([]byte, error) {
 	c, err := json.Marshal(content)
 	if err != nil {
-		return errors.Wrap(err, "could not marshal command content")
+		return nil, errors.Wrap(err, "could not marshal command content")
 	}
 
 	message, err := json.Marshal(Message{
+		ID:      id,
 		Command: cmd,
 		Content: RawMessage{Bytes: c},
 	})
 	if err != nil {
-		return errors.Wrap(err, "could not marshal message for WebSocket")
+		return nil, errors.Wrap(err, "could not marshal message for WebSocket")
+	}
+
+	return message, nil
+}
+
+// SendMessage marshals and sends a message in the provided WebSocket
+// connection. This function uses Message struct to send messages in correct
+// format.
+func SendMessage(conn *websocket.Conn, cmd string, content interface{}) error {
+	return SendReply(conn, "", cmd, content)
+}
+
+// SendReply marshals and sends a message in the provided WebSocket
+// connection, echoing ID of the request it replies to.
+func SendReply(conn *websocket.Conn, id, cmd string, content interface{}) error {
+	if conn == nil {
+		return errors.New("no websocket connection provided")
+	}
+
+	message, err := NewReply(id, cmd, content)
+	if err != nil {
+		return err
 	}
 
 	err = conn.WriteMessage(websocket.TextMessage, message)